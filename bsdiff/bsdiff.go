@@ -0,0 +1,268 @@
+// Package bsdiff produces and applies patches in BSDIFF40 format, compatible with standard bsdiff and bspatch tools.
+// Unlike content defined chunking, bsdiff uses approximate matches: bytes of matched regions are stored as differences
+// which are mostly zeros when addresses shift in compiled binaries, so they compress very well
+package bsdiff
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	bzip2writer "file-diff/internal/bzip2"
+)
+
+const (
+	magic      = "BSDIFF40"
+	headerSize = 32
+	// mismatchLimit is how many more bytes an exact match must have than the approximate one to start a new region
+	mismatchLimit = 8
+)
+
+// ErrCorruptPatch is returned when patch can't be applied
+var ErrCorruptPatch = errors.New("corrupt patch")
+
+// Diff writes BSDIFF40 patch which transforms original into updated
+func Diff(original, updated []byte, patch io.Writer) error {
+	index := suffixSort(original)
+
+	control, diff, extra := &bytes.Buffer{}, &bytes.Buffer{}, &bytes.Buffer{}
+	controlWriter, diffWriter, extraWriter := bzip2writer.NewWriter(control), bzip2writer.NewWriter(diff), bzip2writer.NewWriter(extra)
+
+	var scan, length, position, lastScan, lastPosition, lastOffset int
+	for scan < len(updated) {
+		oldScore := 0
+		scan += length
+		// find the next exact match which is considerably better than continuing the current approximate one
+		for scsc := scan; scan < len(updated); scan++ {
+			position, length = search(index, original, updated[scan:], 0, len(original))
+			for ; scsc < scan+length; scsc++ {
+				if scsc+lastOffset < len(original) && original[scsc+lastOffset] == updated[scsc] {
+					oldScore++
+				}
+			}
+			if (length == oldScore && length != 0) || length > oldScore+mismatchLimit {
+				break
+			}
+			if scan+lastOffset < len(original) && original[scan+lastOffset] == updated[scan] {
+				oldScore--
+			}
+		}
+
+		if length == oldScore && scan != len(updated) {
+			continue
+		}
+
+		// extend the previous match forwards and the new one backwards as long as at least half of bytes match
+		forwardLength, score, bestScore := 0, 0, 0
+		for i := 0; lastScan+i < scan && lastPosition+i < len(original); {
+			if original[lastPosition+i] == updated[lastScan+i] {
+				score++
+			}
+			i++
+			if score*2-i > bestScore*2-forwardLength {
+				bestScore, forwardLength = score, i
+			}
+		}
+
+		backwardLength := 0
+		if scan < len(updated) {
+			score, bestScore = 0, 0
+			for i := 1; scan >= lastScan+i && position >= i; i++ {
+				if original[position-i] == updated[scan-i] {
+					score++
+				}
+				if score*2-i > bestScore*2-backwardLength {
+					bestScore, backwardLength = score, i
+				}
+			}
+		}
+
+		// both extensions overlap, the overlap is split where it fits the best
+		if lastScan+forwardLength > scan-backwardLength {
+			overlap := (lastScan + forwardLength) - (scan - backwardLength)
+			score, bestScore, split := 0, 0, 0
+			for i := 0; i < overlap; i++ {
+				if updated[lastScan+forwardLength-overlap+i] == original[lastPosition+forwardLength-overlap+i] {
+					score++
+				}
+				if updated[scan-backwardLength+i] == original[position-backwardLength+i] {
+					score--
+				}
+				if score > bestScore {
+					bestScore, split = score, i+1
+				}
+			}
+			forwardLength += split - overlap
+			backwardLength -= split
+		}
+
+		differences := make([]byte, forwardLength)
+		for i := range differences {
+			differences[i] = updated[lastScan+i] - original[lastPosition+i]
+		}
+		diffWriter.Write(differences)
+		extraWriter.Write(updated[lastScan+forwardLength : scan-backwardLength])
+
+		controlEntry := make([]byte, 24)
+		putOffset(controlEntry[0:], forwardLength)
+		putOffset(controlEntry[8:], (scan-backwardLength)-(lastScan+forwardLength))
+		putOffset(controlEntry[16:], (position-backwardLength)-(lastPosition+forwardLength))
+		controlWriter.Write(controlEntry)
+
+		lastScan = scan - backwardLength
+		lastPosition = position - backwardLength
+		lastOffset = position - scan
+	}
+
+	for _, w := range []*bzip2writer.Writer{controlWriter, diffWriter, extraWriter} {
+		if err := w.Close(); err != nil {
+			return fmt.Errorf("failed to compress patch: %w", err)
+		}
+	}
+
+	header := make([]byte, headerSize)
+	copy(header, magic)
+	putOffset(header[8:], control.Len())
+	putOffset(header[16:], diff.Len())
+	putOffset(header[24:], len(updated))
+	for _, part := range [][]byte{header, control.Bytes(), diff.Bytes(), extra.Bytes()} {
+		if _, err := patch.Write(part); err != nil {
+			return fmt.Errorf("failed to write patch: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Patch applies BSDIFF40 patch on original and writes the updated file to w
+func Patch(original []byte, patch io.Reader, w io.Writer) error {
+	data, err := io.ReadAll(patch)
+	if err != nil {
+		return fmt.Errorf("failed to read patch: %w", err)
+	}
+	if len(data) < headerSize || string(data[:len(magic)]) != magic {
+		return fmt.Errorf("%w: unknown format", ErrCorruptPatch)
+	}
+	// lengths come from the patch, so they are compared with what is left instead of being added up
+	controlLength, diffLength, updatedSize := offset(data[8:]), offset(data[16:]), offset(data[24:])
+	left := int64(len(data) - headerSize)
+	if controlLength < 0 || diffLength < 0 || updatedSize < 0 || controlLength > left || diffLength > left-controlLength {
+		return fmt.Errorf("%w: invalid header", ErrCorruptPatch)
+	}
+
+	controlStart := int64(headerSize)
+	diffStart := controlStart + controlLength
+	extraStart := diffStart + diffLength
+	control := bzip2.NewReader(bytes.NewReader(data[controlStart:diffStart]))
+	diff := bzip2.NewReader(bytes.NewReader(data[diffStart:extraStart]))
+	extra := bzip2.NewReader(bytes.NewReader(data[extraStart:]))
+
+	// updated file grows only with decoded data, declared size isn't allocated upfront
+	updated := &bytes.Buffer{}
+	updated.Grow(int(minInt64(updatedSize, int64(len(original)))))
+	controlEntry := make([]byte, 24)
+	originalPosition := int64(0)
+	for int64(updated.Len()) < updatedSize {
+		if _, err = io.ReadFull(control, controlEntry); err != nil {
+			return fmt.Errorf("%w: failed to read control block: %v", ErrCorruptPatch, err)
+		}
+		diffLength, extraLength, seek := offset(controlEntry[0:]), offset(controlEntry[8:]), offset(controlEntry[16:])
+		if diffLength < 0 || diffLength > updatedSize-int64(updated.Len()) {
+			return fmt.Errorf("%w: invalid control entry", ErrCorruptPatch)
+		}
+
+		start := updated.Len()
+		if err = readFull(updated, diff, diffLength); err != nil {
+			return fmt.Errorf("%w: failed to read diff block: %v", ErrCorruptPatch, err)
+		}
+		for i, difference := range updated.Bytes()[start:] {
+			if position := originalPosition + int64(i); position >= 0 && position < int64(len(original)) {
+				updated.Bytes()[start+i] = difference + original[position]
+			}
+		}
+		originalPosition += diffLength
+
+		if extraLength < 0 || extraLength > updatedSize-int64(updated.Len()) {
+			return fmt.Errorf("%w: invalid control entry", ErrCorruptPatch)
+		}
+		if err = readFull(updated, extra, extraLength); err != nil {
+			return fmt.Errorf("%w: failed to read extra block: %v", ErrCorruptPatch, err)
+		}
+		originalPosition += seek
+	}
+
+	if _, err = w.Write(updated.Bytes()); err != nil {
+		return fmt.Errorf("failed to write updated file: %w", err)
+	}
+	return nil
+}
+
+// readFull appends exactly length bytes of r to buffer. Buffer grows only with data which is actually read,
+// so length declared by the patch can't exhaust memory
+func readFull(buffer *bytes.Buffer, r io.Reader, length int64) error {
+	n, err := io.CopyN(buffer, r, length)
+	if err == io.EOF && n < length {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// search returns position and length of the longest match of data among suffixes of original
+// between index entries start and end
+func search(index []int, original, data []byte, start, end int) (int, int) {
+	for end-start >= 2 {
+		middle := start + (end-start)/2
+		suffix := original[index[middle]:]
+		if len(suffix) > len(data) {
+			suffix = suffix[:len(data)]
+		}
+		if bytes.Compare(suffix, data[:len(suffix)]) < 0 {
+			start = middle
+		} else {
+			end = middle
+		}
+	}
+
+	startLength := matchLength(original[index[start]:], data)
+	endLength := matchLength(original[index[end]:], data)
+	if startLength > endLength {
+		return index[start], startLength
+	}
+	return index[end], endLength
+}
+
+func matchLength(a, b []byte) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// putOffset writes value in bsdiff's sign and magnitude little endian form
+func putOffset(buffer []byte, value int) {
+	if value < 0 {
+		binary.LittleEndian.PutUint64(buffer, uint64(-value)|1<<63)
+		return
+	}
+	binary.LittleEndian.PutUint64(buffer, uint64(value))
+}
+
+func offset(buffer []byte) int64 {
+	value := binary.LittleEndian.Uint64(buffer)
+	magnitude := int64(value &^ (1 << 63))
+	if value&(1<<63) != 0 {
+		return -magnitude
+	}
+	return magnitude
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,243 @@
+package bsdiff
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	bzip2writer "file-diff/internal/bzip2"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffAndPatch(t *testing.T) {
+	binaryOriginal := randomData(1, 64*1024)
+	binaryUpdated := append([]byte{}, binaryOriginal...)
+	// shifted addresses, as in recompiled executables
+	for i := 0; i+4 <= len(binaryUpdated); i += 256 {
+		binary.LittleEndian.PutUint32(binaryUpdated[i:], binary.LittleEndian.Uint32(binaryUpdated[i:])+16)
+	}
+
+	testCases := map[string]struct {
+		original []byte
+		updated  []byte
+	}{
+		"should patch identical files": {
+			original: []byte("Hello everyone, this will be a very short text about nothing."),
+			updated:  []byte("Hello everyone, this will be a very short text about nothing."),
+		},
+		"should patch empty original": {
+			original: []byte{},
+			updated:  []byte("Hello everyone"),
+		},
+		"should patch empty updated": {
+			original: []byte("Hello everyone"),
+			updated:  []byte{},
+		},
+		"should patch text with inserted and removed parts": {
+			original: []byte("Hello everyone, this will be a very short text about nothing."),
+			updated:  []byte("Hello, this will be a slightly longer text about nothing at all."),
+		},
+		"should patch moved blocks": {
+			original: append(randomData(2, 4096), randomData(3, 4096)...),
+			updated:  append(randomData(3, 4096), randomData(2, 4096)...),
+		},
+		"should patch binary with shifted addresses": {
+			original: binaryOriginal,
+			updated:  binaryUpdated,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// given
+			patch := &bytes.Buffer{}
+			require.NoError(t, Diff(tc.original, tc.updated, patch))
+
+			// when
+			updated := &bytes.Buffer{}
+			err := Patch(tc.original, patch, updated)
+
+			// then
+			require.NoError(t, err)
+			assert.Equal(t, string(tc.updated), updated.String())
+		})
+	}
+
+	t.Run("should write small patch for shifted addresses", func(t *testing.T) {
+		// given
+		patch := &bytes.Buffer{}
+
+		// when
+		err := Diff(binaryOriginal, binaryUpdated, patch)
+
+		// then
+		require.NoError(t, err)
+		assert.Equal(t, "BSDIFF40", patch.String()[:8])
+		assert.Less(t, patch.Len(), len(binaryUpdated)/20)
+	})
+}
+
+func TestPatchErrors(t *testing.T) {
+	original := []byte("Hello everyone, this will be a very short text about nothing.")
+	patch := &bytes.Buffer{}
+	require.NoError(t, Diff(original, []byte("Hello, this will be a short text."), patch))
+	valid := patch.Bytes()
+
+	testCases := map[string]struct {
+		patch []byte
+	}{
+		"should fail for unknown format": {
+			patch: append([]byte("BSDIFF41"), valid[8:]...),
+		},
+		"should fail for truncated header": {
+			patch: valid[:16],
+		},
+		"should fail for missing extra block": {
+			patch: valid[:headerSize+offset(valid[8:])+offset(valid[16:])],
+		},
+		"should fail for corrupt control block": {
+			patch: append(append(append([]byte{}, valid[:headerSize+4]...), 0xff, 0xff), valid[headerSize+6:]...),
+		},
+		"should fail for diff longer than diff block": {
+			patch: craftPatch(t, 1<<40, []int{1 << 40, 0, 0}, []byte("diff"), nil),
+		},
+		"should fail for extra longer than extra block": {
+			patch: craftPatch(t, 1<<40, []int{0, 1 << 40, 0}, nil, []byte("extra")),
+		},
+		"should fail for lengths overflowing updated size": {
+			patch: craftPatch(t, 1<<40, []int{1 << 62, 1 << 62, 0}, nil, nil),
+		},
+		"should fail for control entry longer than updated size": {
+			patch: craftPatch(t, 4, []int{2, 3, 0}, []byte("di"), []byte("ext")),
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// when
+			err := Patch(original, bytes.NewReader(tc.patch), &bytes.Buffer{})
+
+			// then
+			assert.ErrorIs(t, err, ErrCorruptPatch)
+		})
+	}
+}
+
+func TestReferencePatch(t *testing.T) {
+	// testdata/bsdiff.patch was made by bsdiff 4.3 tool: bsdiff original updated bsdiff.patch
+	original := readTestFile(t, "original")
+	updated := readTestFile(t, "updated")
+	reference := readTestFile(t, "bsdiff.patch")
+
+	t.Run("should apply patch made by bsdiff", func(t *testing.T) {
+		// when
+		patched := &bytes.Buffer{}
+		err := Patch(original, bytes.NewReader(reference), patched)
+
+		// then
+		require.NoError(t, err)
+		assert.Equal(t, updated, patched.Bytes())
+	})
+
+	t.Run("should write the same blocks as bsdiff", func(t *testing.T) {
+		// given
+		patch := &bytes.Buffer{}
+
+		// when
+		err := Diff(original, updated, patch)
+
+		// then
+		require.NoError(t, err)
+		// compressed bytes depend on bzip2 implementation, so blocks are compared decompressed
+		assert.Equal(t, reference[24:headerSize], patch.Bytes()[24:headerSize])
+		assert.Equal(t, decompressBlocks(t, reference), decompressBlocks(t, patch.Bytes()))
+	})
+}
+
+func TestSuffixSort(t *testing.T) {
+	testCases := map[string]struct {
+		data []byte
+	}{
+		"should sort suffixes of empty data": {
+			data: []byte{},
+		},
+		"should sort suffixes of text": {
+			data: []byte("abracadabra, mississippi"),
+		},
+		"should sort suffixes of repeated data": {
+			data: bytes.Repeat([]byte("ab"), 100),
+		},
+		"should sort suffixes of random data": {
+			data: randomData(4, 1000),
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// when
+			index := suffixSort(tc.data)
+
+			// then
+			require.Len(t, index, len(tc.data)+1)
+			for i := 1; i < len(index); i++ {
+				assert.Negative(t, bytes.Compare(tc.data[index[i-1]:], tc.data[index[i]:]))
+			}
+		})
+	}
+}
+
+func randomData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// craftPatch builds patch with given control entries, diff and extra data, without checking them
+func craftPatch(t *testing.T, updatedSize int, control []int, diff, extra []byte) []byte {
+	entries := make([]byte, 8*len(control))
+	for i, value := range control {
+		putOffset(entries[8*i:], value)
+	}
+	blocks := make([][]byte, 0, 3)
+	for _, block := range [][]byte{entries, diff, extra} {
+		compressed := &bytes.Buffer{}
+		w := bzip2writer.NewWriter(compressed)
+		_, err := w.Write(block)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		blocks = append(blocks, compressed.Bytes())
+	}
+
+	header := make([]byte, headerSize)
+	copy(header, magic)
+	putOffset(header[8:], len(blocks[0]))
+	putOffset(header[16:], len(blocks[1]))
+	putOffset(header[24:], updatedSize)
+	return bytes.Join(append([][]byte{header}, blocks...), nil)
+}
+
+// decompressBlocks returns decompressed control, diff and extra blocks of the patch
+func decompressBlocks(t *testing.T, patch []byte) [][]byte {
+	controlEnd := headerSize + offset(patch[8:])
+	diffEnd := controlEnd + offset(patch[16:])
+	blocks := make([][]byte, 0, 3)
+	for _, block := range [][]byte{patch[headerSize:controlEnd], patch[controlEnd:diffEnd], patch[diffEnd:]} {
+		data, err := io.ReadAll(bzip2.NewReader(bytes.NewReader(block)))
+		require.NoError(t, err)
+		blocks = append(blocks, data)
+	}
+	return blocks
+}
+
+func readTestFile(t *testing.T, name string) []byte {
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	require.NoError(t, err)
+	return data
+}
@@ -0,0 +1,144 @@
+package bsdiff
+
+// suffixSort returns start positions of all suffixes of data, including the empty one, in lexicographic order.
+// It's Larsson and Sadakane's qsufsort, the same algorithm bsdiff uses: suffixes are sorted by prefix doubling,
+// groups of suffixes with equal prefixes are refined with ternary split sort
+func suffixSort(data []byte) []int {
+	n := len(data)
+	index := make([]int, n+1)
+	// group is for every suffix the last position in index of its group of suffixes with equal prefix
+	group := make([]int, n+1)
+
+	var buckets [256]int
+	for _, b := range data {
+		buckets[b]++
+	}
+	for i := 1; i < 256; i++ {
+		buckets[i] += buckets[i-1]
+	}
+	for i := 255; i > 0; i-- {
+		buckets[i] = buckets[i-1]
+	}
+	buckets[0] = 0
+
+	for i, b := range data {
+		buckets[b]++
+		index[buckets[b]] = i
+	}
+	index[0] = n
+	for i, b := range data {
+		group[i] = buckets[b]
+	}
+	group[n] = 0
+	// negative values in index are lengths of already sorted runs
+	for i := 1; i < 256; i++ {
+		if buckets[i] == buckets[i-1]+1 {
+			index[buckets[i]] = -1
+		}
+	}
+	index[0] = -1
+
+	for h := 1; index[0] != -(n + 1); h += h {
+		sorted := 0
+		i := 0
+		for i < n+1 {
+			if index[i] < 0 {
+				sorted -= index[i]
+				i -= index[i]
+				continue
+			}
+			if sorted > 0 {
+				index[i-sorted] = -sorted
+			}
+			length := group[index[i]] + 1 - i
+			split(index, group, i, length, h)
+			i += length
+			sorted = 0
+		}
+		if sorted > 0 {
+			index[i-sorted] = -sorted
+		}
+	}
+
+	for i := 0; i < n+1; i++ {
+		index[group[i]] = i
+	}
+	return index
+}
+
+// split sorts length suffixes in index from start by their group h positions further
+func split(index, group []int, start, length, h int) {
+	if length < 16 {
+		// selection sort for small groups
+		for k := start; k < start+length; {
+			j := 1
+			x := group[index[k]+h]
+			for i := 1; k+i < start+length; i++ {
+				if group[index[k+i]+h] < x {
+					x = group[index[k+i]+h]
+					j = 0
+				}
+				if group[index[k+i]+h] == x {
+					index[k+j], index[k+i] = index[k+i], index[k+j]
+					j++
+				}
+			}
+			for i := 0; i < j; i++ {
+				group[index[k+i]] = k + j - 1
+			}
+			if j == 1 {
+				index[k] = -1
+			}
+			k += j
+		}
+		return
+	}
+
+	x := group[index[start+length/2]+h]
+	smaller, equal := 0, 0
+	for i := start; i < start+length; i++ {
+		if group[index[i]+h] < x {
+			smaller++
+		}
+		if group[index[i]+h] == x {
+			equal++
+		}
+	}
+	equalStart := start + smaller
+	greaterStart := equalStart + equal
+
+	i, j, k := start, 0, 0
+	for i < equalStart {
+		switch {
+		case group[index[i]+h] < x:
+			i++
+		case group[index[i]+h] == x:
+			index[i], index[equalStart+j] = index[equalStart+j], index[i]
+			j++
+		default:
+			index[i], index[greaterStart+k] = index[greaterStart+k], index[i]
+			k++
+		}
+	}
+	for equalStart+j < greaterStart {
+		if group[index[equalStart+j]+h] == x {
+			j++
+		} else {
+			index[equalStart+j], index[greaterStart+k] = index[greaterStart+k], index[equalStart+j]
+			k++
+		}
+	}
+
+	if equalStart > start {
+		split(index, group, start, equalStart-start, h)
+	}
+	for i := 0; i < greaterStart-equalStart; i++ {
+		group[index[equalStart+i]] = greaterStart - 1
+	}
+	if equalStart == greaterStart-1 {
+		index[equalStart] = -1
+	}
+	if start+length > greaterStart {
+		split(index, group, greaterStart, start+length-greaterStart, h)
+	}
+}
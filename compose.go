@@ -0,0 +1,90 @@
+package filediff
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Compose merges delta d12 (version 1 to 2) and delta d23 (version 2 to 3) into a single delta from version 1
+// to version 3, without materializing version 2. Patch with the composed delta produces exactly the same bytes
+// as applying both deltas in sequence. Composed delta has only Ops, Reused and Changed chunks are empty
+func Compose(d12, d23 *Delta) (*Delta, error) {
+	if d12.TargetSize != d23.BaseSize {
+		return nil, fmt.Errorf("%w: second delta expects base of %d bytes, first one produces %d bytes",
+			ErrInvalidDelta, d23.BaseSize, d12.TargetSize)
+	}
+	if d12.TargetHash != "" && d23.BaseHash != "" && d12.TargetHash != d23.BaseHash {
+		return nil, fmt.Errorf("%w: second delta was computed from a different version", ErrBaseMismatch)
+	}
+
+	// starts[i] is offset in version 2 where data produced by d12.Ops[i] begins
+	starts := make([]int, len(d12.Ops))
+	produced := 0
+	for i, op := range d12.Ops {
+		if op.Type == OpInsert && len(op.Data) != op.Length {
+			return nil, fmt.Errorf("%w: insert of %d bytes has %d bytes of data", ErrInvalidDelta, op.Length, len(op.Data))
+		}
+		if op.Type == OpCopy && copyOutOfBounds(op, d12.BaseSize) {
+			return nil, fmt.Errorf("%w: copy of %d bytes at %d is out of original file", ErrInvalidDelta, op.Length, op.Offset)
+		}
+		if op.Length > d12.TargetSize-produced {
+			return nil, fmt.Errorf("%w: first delta produces more than %d bytes", ErrInvalidDelta, d12.TargetSize)
+		}
+		starts[i] = produced
+		produced += op.Length
+	}
+	if produced != d12.TargetSize {
+		return nil, fmt.Errorf("%w: first delta produces %d bytes, expected %d", ErrInvalidDelta, produced, d12.TargetSize)
+	}
+
+	ops := make([]Op, 0, len(d23.Ops))
+	for _, op := range d23.Ops {
+		switch op.Type {
+		case OpInsert:
+			ops = appendInsert(ops, op.Data)
+		case OpCopy:
+			if copyOutOfBounds(op, d23.BaseSize) {
+				return nil, fmt.Errorf("%w: copy of %d bytes at %d is out of original file", ErrInvalidDelta, op.Length, op.Offset)
+			}
+			// first op of d12 which produces data at the copied offset
+			i := sort.Search(len(starts), func(i int) bool {
+				return starts[i]+d12.Ops[i].Length > op.Offset
+			})
+			offset, remaining := op.Offset, op.Length
+			for ; remaining > 0; i++ {
+				// sizes of both deltas match, so it's reached only when ops don't agree with them
+				if i == len(d12.Ops) {
+					return nil, fmt.Errorf("%w: copy of %d bytes at %d is out of first delta", ErrInvalidDelta, op.Length, op.Offset)
+				}
+				source := d12.Ops[i]
+				skip := offset - starts[i]
+				length := source.Length - skip
+				if length > remaining {
+					length = remaining
+				}
+				if length == 0 {
+					continue
+				}
+				if source.Type == OpCopy {
+					ops = appendCopy(ops, source.Offset+skip, length)
+				} else {
+					ops = appendInsert(ops, source.Data[skip:skip+length])
+				}
+				offset += length
+				remaining -= length
+			}
+		default:
+			return nil, fmt.Errorf("%w: unknown op type %d", ErrInvalidDelta, op.Type)
+		}
+	}
+
+	return &Delta{
+		Reused:     make([]Chunk, 0),
+		Changed:    make([]Chunk, 0),
+		Ops:        ops,
+		BaseSize:   d12.BaseSize,
+		TargetSize: d23.TargetSize,
+		BaseHash:   d12.BaseHash,
+		TargetHash: d23.TargetHash,
+	}, nil
+}
@@ -0,0 +1,117 @@
+package filediff
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompose(t *testing.T) {
+	v1 := randomData(1, 256*1024)
+	modified := append(append(append([]byte{}, v1[:100*1024]...), randomData(2, 100)...), v1[100*1024:]...)
+	moved := append(append([]byte{}, modified[128*1024:]...), modified[:128*1024]...)
+
+	testCases := map[string]struct {
+		v2 []byte
+		v3 []byte
+	}{
+		"should compose deltas of unchanged file": {
+			v2: v1,
+			v3: v1,
+		},
+		"should compose modification and move": {
+			v2: modified,
+			v3: moved,
+		},
+		"should compose deltas copying inserted data": {
+			v2: randomData(3, 64*1024),
+			v3: append(append([]byte{}, v1[:64*1024]...), randomData(3, 64*1024)...),
+		},
+		"should compose deltas with empty middle version": {
+			v2: []byte{},
+			v3: v1,
+		},
+		"should compose deltas with empty last version": {
+			v2: modified,
+			v3: []byte{},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// given
+			d12, err := Diff(v1, tc.v2, 4096)
+			require.NoError(t, err)
+			d23, err := Diff(tc.v2, tc.v3, 4096)
+			require.NoError(t, err)
+
+			// when
+			d13, err := Compose(d12, d23)
+
+			// then
+			require.NoError(t, err)
+			patched := &bytes.Buffer{}
+			require.NoError(t, Patch(bytes.NewReader(v1), d13, patched))
+			assert.Equal(t, string(tc.v3), patched.String())
+		})
+	}
+
+	t.Run("should reject copy out of original file", func(t *testing.T) {
+		d12, err := Diff(v1, modified, 4096)
+		require.NoError(t, err)
+		testCases := map[string]struct {
+			d12 *Delta
+			d23 *Delta
+		}{
+			"overflowing copy of second delta": {
+				d12: d12,
+				d23: &Delta{BaseSize: len(modified), TargetSize: 1, Ops: []Op{{Type: OpCopy, Offset: math.MaxInt, Length: 1}}},
+			},
+			"overflowing copy of first delta": {
+				d12: &Delta{BaseSize: 1, TargetSize: 1, Ops: []Op{{Type: OpCopy, Offset: math.MaxInt, Length: 1}}},
+				d23: &Delta{BaseSize: 1, TargetSize: 1, Ops: []Op{{Type: OpCopy, Offset: 0, Length: 1}}},
+			},
+		}
+
+		for name, tc := range testCases {
+			t.Run(name, func(t *testing.T) {
+				// when
+				_, err := Compose(tc.d12, tc.d23)
+
+				// then
+				assert.ErrorIs(t, err, ErrInvalidDelta)
+			})
+		}
+	})
+
+	t.Run("should not compose deltas of unrelated versions", func(t *testing.T) {
+		// given
+		d12, err := Diff(v1, modified, 4096)
+		require.NoError(t, err)
+		d23, err := Diff(v1, moved, 4096)
+		require.NoError(t, err)
+
+		// when
+		_, err = Compose(d12, d23)
+
+		// then
+		assert.ErrorIs(t, err, ErrInvalidDelta)
+	})
+
+	t.Run("should not compose deltas of different versions of the same size", func(t *testing.T) {
+		// given
+		d12, err := Diff(v1, modified, 4096)
+		require.NoError(t, err)
+		d23, err := Diff(moved, v1, 4096)
+		require.NoError(t, err)
+
+		// when
+		_, err = Compose(d12, d23)
+
+		// then
+		assert.ErrorIs(t, err, ErrBaseMismatch)
+	})
+}
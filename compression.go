@@ -0,0 +1,248 @@
+package filediff
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/lzw"
+	"compress/zlib"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Codec is a compression algorithm of literal data in encoded delta
+type Codec byte
+
+const (
+	// CodecNone stores literal data as is
+	CodecNone Codec = iota
+	CodecFlate
+	CodecGzip
+	CodecZlib
+	CodecLZW
+	// CodecFlateDictionary compresses data of every insert with flate, using original bytes around the place
+	// of the insert as a preset dictionary. Original file is needed to decode such delta (see WithDictionary)
+	CodecFlateDictionary
+)
+
+// ErrOriginalRequired is returned when delta compressed with WithDictionary is encoded or decoded without original file
+var ErrOriginalRequired = errors.New("original file is required for dictionary compression")
+
+// dictionarySize is how many original bytes are used as a dictionary, it's the flate window size
+const dictionarySize = 32 * 1024
+
+// CompressionMode decides what is compressed as a single unit
+type CompressionMode byte
+
+const (
+	// PerOp compresses data of every insert separately. Data which doesn't compress is stored as is
+	PerOp CompressionMode = iota + 1
+	// PerStream compresses whole encoded delta as a single stream
+	PerStream
+)
+
+// literal data of PerOp compressed insert
+const (
+	rawData byte = iota
+	compressedData
+)
+
+type encodeOptions struct {
+	codec      Codec
+	mode       CompressionMode
+	original   io.ReaderAt
+	signingKey ed25519.PrivateKey
+	recipients []*ecdh.PublicKey
+}
+
+// EncodeOption configures Delta.Encode
+type EncodeOption func(*encodeOptions)
+
+type decodeOptions struct {
+	original      io.ReaderAt
+	trustedKeys   KeyRing
+	decryptionKey *ecdh.PrivateKey
+}
+
+// DecodeOption configures DecodeDelta
+type DecodeOption func(*decodeOptions)
+
+// WithCompression compresses literal data with codec, either every insert separately or whole delta at once.
+// Codec is recorded in the header, so DecodeDelta decompresses data transparently
+func WithCompression(codec Codec, mode CompressionMode) EncodeOption {
+	return func(o *encodeOptions) {
+		o.codec = codec
+		o.mode = mode
+	}
+}
+
+// WithDictionary compresses data of every insert with flate, using original bytes around the place
+// of the insert as a preset dictionary. It squeezes redundancy which chunk matching misses, e.g. in a record
+// with a single field edited. Delta must be decoded with WithOriginal and the same original file
+func WithDictionary(original io.ReaderAt) EncodeOption {
+	return func(o *encodeOptions) {
+		o.codec = CodecFlateDictionary
+		o.mode = PerOp
+		o.original = original
+	}
+}
+
+// WithOriginal provides original file to DecodeDelta, it's needed for deltas encoded with WithDictionary
+func WithOriginal(original io.ReaderAt) DecodeOption {
+	return func(o *decodeOptions) {
+		o.original = original
+	}
+}
+
+func (o encodeOptions) validate() error {
+	if o.codec > CodecFlateDictionary {
+		return fmt.Errorf("%w: unknown codec %d", ErrInvalidDelta, o.codec)
+	}
+	if o.codec != CodecNone && o.mode != PerOp && o.mode != PerStream {
+		return fmt.Errorf("%w: unknown compression mode %d", ErrInvalidDelta, o.mode)
+	}
+	if o.codec == CodecFlateDictionary && o.mode != PerOp {
+		return fmt.Errorf("%w: dictionary compression works only per op", ErrInvalidDelta)
+	}
+	return nil
+}
+
+// dictionary returns original bytes around end of the previously copied original data, where
+// the inserted data most likely replaces original content
+func dictionary(original io.ReaderAt, baseSize, end int) ([]byte, error) {
+	start := end - dictionarySize/2
+	if start+dictionarySize > baseSize {
+		start = baseSize - dictionarySize
+	}
+	if start < 0 {
+		start = 0
+	}
+	stop := start + dictionarySize
+	if stop > baseSize {
+		stop = baseSize
+	}
+
+	data := make([]byte, stop-start)
+	if _, err := original.ReadAt(data, int64(start)); err != nil {
+		return nil, fmt.Errorf("failed to read original data: %w", err)
+	}
+	return data, nil
+}
+
+func compressor(codec Codec, w io.Writer, dict []byte) (io.WriteCloser, error) {
+	switch codec {
+	case CodecFlate:
+		return flate.NewWriter(w, flate.DefaultCompression)
+	case CodecFlateDictionary:
+		// lower levels give up on most matches reaching far back into the dictionary,
+		// inserts are small so the best compression is still cheap
+		return flate.NewWriterDict(w, flate.BestCompression, dict)
+	case CodecGzip:
+		return gzip.NewWriter(w), nil
+	case CodecZlib:
+		return zlib.NewWriter(w), nil
+	case CodecLZW:
+		return lzw.NewWriter(w, lzw.LSB, 8), nil
+	default:
+		return nil, fmt.Errorf("%w: unknown codec %d", ErrInvalidDelta, codec)
+	}
+}
+
+func decompressor(codec Codec, r io.Reader, dict []byte) (io.ReadCloser, error) {
+	switch codec {
+	case CodecFlate:
+		return flate.NewReader(r), nil
+	case CodecFlateDictionary:
+		return flate.NewReaderDict(r, dict), nil
+	case CodecGzip:
+		reader, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress delta: %w", err)
+		}
+		return reader, nil
+	case CodecZlib:
+		reader, err := zlib.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress delta: %w", err)
+		}
+		return reader, nil
+	case CodecLZW:
+		return lzw.NewReader(r, lzw.LSB, 8), nil
+	default:
+		return nil, fmt.Errorf("%w: unknown codec %d", ErrInvalidDelta, codec)
+	}
+}
+
+// writeCompressed writes literal data of a single insert compressed with codec, unless compression
+// doesn't make it smaller
+func writeCompressed(w *bufio.Writer, codec Codec, data, dict []byte) error {
+	compressed := &bytes.Buffer{}
+	stream, err := compressor(codec, compressed, dict)
+	if err != nil {
+		return err
+	}
+	stream.Write(data)
+	if err = stream.Close(); err != nil {
+		return fmt.Errorf("failed to compress data: %w", err)
+	}
+
+	if compressed.Len() >= len(data) {
+		w.WriteByte(rawData)
+		w.Write(data)
+		return nil
+	}
+	w.WriteByte(compressedData)
+	writeUvarint(w, uint64(compressed.Len()))
+	w.Write(compressed.Bytes())
+	return nil
+}
+
+// readCompressed reads literal data of a single insert written with writeCompressed
+func readCompressed(r *bufio.Reader, codec Codec, length int, dict []byte) ([]byte, error) {
+	kind, err := r.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read delta: %w", err)
+	}
+	switch kind {
+	case rawData:
+		data, err := readLimited(r, length)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read delta: %w", err)
+		}
+		return data, nil
+	case compressedData:
+	default:
+		return nil, fmt.Errorf("%w: unknown data kind %d", ErrInvalidDelta, kind)
+	}
+
+	compressedLength, err := readUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	// compressed data is stored only when it's smaller
+	if compressedLength >= length {
+		return nil, fmt.Errorf("%w: compressed data of %d bytes is not smaller than %d bytes", ErrInvalidDelta, compressedLength, length)
+	}
+	compressed, err := readLimited(r, compressedLength)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read delta: %w", err)
+	}
+	stream, err := decompressor(codec, bytes.NewReader(compressed), dict)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	data, err := readLimited(stream, length)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress data: %w", err)
+	}
+	if n, _ := stream.Read(make([]byte, 1)); n > 0 {
+		return nil, fmt.Errorf("%w: compressed data is longer than %d bytes", ErrInvalidDelta, length)
+	}
+
+	return data, nil
+}
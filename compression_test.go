@@ -0,0 +1,134 @@
+package filediff
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompression(t *testing.T) {
+	original := randomText(1, 64*1024)
+	updated := append(append(append([]byte{}, original[:32*1024]...), randomText(2, 16*1024)...), original[32*1024:]...)
+
+	testCases := map[string]struct {
+		codec Codec
+		mode  CompressionMode
+	}{
+		"should compress every insert with flate": {codec: CodecFlate, mode: PerOp},
+		"should compress every insert with gzip":  {codec: CodecGzip, mode: PerOp},
+		"should compress every insert with zlib":  {codec: CodecZlib, mode: PerOp},
+		"should compress every insert with lzw":   {codec: CodecLZW, mode: PerOp},
+		"should compress stream with flate":       {codec: CodecFlate, mode: PerStream},
+		"should compress stream with gzip":        {codec: CodecGzip, mode: PerStream},
+		"should compress stream with zlib":        {codec: CodecZlib, mode: PerStream},
+		"should compress stream with lzw":         {codec: CodecLZW, mode: PerStream},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// given
+			delta, err := Diff(original, updated, 1024)
+			require.NoError(t, err)
+			uncompressed := &bytes.Buffer{}
+			require.NoError(t, delta.Encode(uncompressed))
+
+			// when
+			compressed := &bytes.Buffer{}
+			err = delta.Encode(compressed, WithCompression(tc.codec, tc.mode))
+
+			// then
+			require.NoError(t, err)
+			assert.Less(t, compressed.Len(), uncompressed.Len()*3/4)
+			decoded, err := DecodeDelta(compressed)
+			require.NoError(t, err)
+			patched := &bytes.Buffer{}
+			require.NoError(t, Patch(bytes.NewReader(original), decoded, patched))
+			assert.Equal(t, string(updated), patched.String())
+		})
+	}
+
+	t.Run("should store incompressible data as is", func(t *testing.T) {
+		// given
+		delta, err := Diff(nil, randomData(1, 16*1024), 1024)
+		require.NoError(t, err)
+
+		// when
+		encoded := &bytes.Buffer{}
+		err = delta.Encode(encoded, WithCompression(CodecFlate, PerOp))
+
+		// then
+		require.NoError(t, err)
+		// header with hashes and ops overhead
+		assert.Less(t, encoded.Len(), 16*1024+128)
+		decoded, err := DecodeDelta(encoded)
+		require.NoError(t, err)
+		assert.Equal(t, delta.Ops, decoded.Ops)
+	})
+
+	t.Run("should not encode with unknown codec", func(t *testing.T) {
+		delta, err := Diff(original, updated, 1024)
+		require.NoError(t, err)
+		assert.ErrorContains(t, delta.Encode(&bytes.Buffer{}, WithCompression(Codec(42), PerOp)), "unknown codec")
+	})
+}
+
+// randomText returns text made of random words, which compresses well
+func randomText(seed int64, size int) []byte {
+	words := []string{"delta", "chunk", "file", "original", "updated", "hash", "rolling", "window", "patch", "store"}
+	random := rand.New(rand.NewSource(seed))
+	text := &bytes.Buffer{}
+	for text.Len() < size {
+		fmt.Fprintf(text, "%s %d ", words[random.Intn(len(words))], random.Intn(1000))
+	}
+	return text.Bytes()[:size]
+}
+
+func TestDictionaryCompression(t *testing.T) {
+	original := randomData(1, 64*1024)
+	// bytes are edited in few places, so changed data is mostly the same as original content
+	updated := append([]byte{}, original...)
+	for _, offset := range []int{1000, 20 * 1024, 50 * 1024} {
+		for i := offset; i < offset+2048; i += 64 {
+			updated[i] ^= 0xff
+		}
+	}
+
+	t.Run("should compress inserts better than without dictionary", func(t *testing.T) {
+		// given
+		delta, err := Diff(original, updated, 1024)
+		require.NoError(t, err)
+		withoutDictionary := &bytes.Buffer{}
+		require.NoError(t, delta.Encode(withoutDictionary, WithCompression(CodecFlate, PerOp)))
+
+		// when
+		withDictionary := &bytes.Buffer{}
+		err = delta.Encode(withDictionary, WithDictionary(bytes.NewReader(original)))
+
+		// then
+		require.NoError(t, err)
+		assert.Less(t, withDictionary.Len(), withoutDictionary.Len()/4)
+		decoded, err := DecodeDelta(withDictionary, WithOriginal(bytes.NewReader(original)))
+		require.NoError(t, err)
+		patched := &bytes.Buffer{}
+		require.NoError(t, Patch(bytes.NewReader(original), decoded, patched))
+		assert.Equal(t, string(updated), patched.String())
+	})
+
+	t.Run("should not decode without original file", func(t *testing.T) {
+		// given
+		delta, err := Diff(original, updated, 1024)
+		require.NoError(t, err)
+		encoded := &bytes.Buffer{}
+		require.NoError(t, delta.Encode(encoded, WithDictionary(bytes.NewReader(original))))
+
+		// when
+		_, err = DecodeDelta(encoded)
+
+		// then
+		assert.ErrorIs(t, err, ErrOriginalRequired)
+	})
+}
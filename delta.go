@@ -0,0 +1,440 @@
+package filediff
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// OpType is a kind of delta instruction
+type OpType byte
+
+const (
+	// OpCopy copies Length bytes of the original file starting at Offset
+	OpCopy OpType = iota + 1
+	// OpInsert inserts Data which isn't present in the original file
+	OpInsert
+)
+
+// Op is a single delta instruction
+type Op struct {
+	Type OpType
+	// Offset in the original file, only for OpCopy
+	Offset int
+	// Length of produced data
+	Length int
+	// Data to insert, only for OpInsert
+	Data []byte
+}
+
+// deltaMagic starts every encoded delta
+var deltaMagic = []byte("FDLT")
+
+// deltaVersion 3 added sizes and hashes of the original and updated files to the header
+const deltaVersion = 3
+
+var (
+	// ErrInvalidDelta is returned when delta can't be applied or decoded
+	ErrInvalidDelta = errors.New("invalid delta")
+	// ErrBaseMismatch is returned when delta is applied on a different file than it was computed from
+	ErrBaseMismatch = errors.New("original file doesn't match delta")
+	// ErrTargetCorrupt is returned when patched data doesn't match hash of the updated file
+	ErrTargetCorrupt = errors.New("patched file is corrupt")
+)
+
+// Patch applies delta on the original file and writes the updated file to w. Original file is verified
+// against size and hash recorded in delta before anything is written. Written data is verified against hash
+// of the updated file only at the end, so it should be discarded when ErrTargetCorrupt is returned.
+// Hashes are checked only when delta has them. Only deltas decoded from git format have none,
+// DecodeDelta rejects delta without hashes
+func Patch(original io.ReaderAt, delta *Delta, w io.Writer) error {
+	if err := verifyBase(original, delta); err != nil {
+		return err
+	}
+
+	target := sha256.New()
+	w = io.MultiWriter(w, target)
+	written := 0
+	for _, op := range delta.Ops {
+		switch op.Type {
+		case OpCopy:
+			if copyOutOfBounds(op, delta.BaseSize) {
+				return fmt.Errorf("%w: copy of %d bytes at %d is out of original file", ErrInvalidDelta, op.Length, op.Offset)
+			}
+			n, err := io.Copy(w, io.NewSectionReader(original, int64(op.Offset), int64(op.Length)))
+			if err != nil {
+				return fmt.Errorf("failed to copy original data: %w", err)
+			}
+			if n != int64(op.Length) {
+				return fmt.Errorf("%w: original file is shorter than %d bytes", ErrInvalidDelta, delta.BaseSize)
+			}
+		case OpInsert:
+			if _, err := w.Write(op.Data); err != nil {
+				return fmt.Errorf("failed to write data: %w", err)
+			}
+		default:
+			return fmt.Errorf("%w: unknown op type %d", ErrInvalidDelta, op.Type)
+		}
+		written += op.Length
+	}
+	if written != delta.TargetSize {
+		return fmt.Errorf("%w: produced %d bytes, expected %d", ErrInvalidDelta, written, delta.TargetSize)
+	}
+	if delta.TargetHash != "" && hex.EncodeToString(target.Sum(nil)) != delta.TargetHash {
+		return ErrTargetCorrupt
+	}
+
+	return nil
+}
+
+// verifyBase checks size of the original file and its hash, when delta has one (see Patch)
+func verifyBase(original io.ReaderAt, delta *Delta) error {
+	base := sha256.New()
+	n, err := io.Copy(base, io.NewSectionReader(original, 0, int64(delta.BaseSize)))
+	if err != nil {
+		return fmt.Errorf("failed to read original data: %w", err)
+	}
+	if n != int64(delta.BaseSize) {
+		return fmt.Errorf("%w: original file is shorter than %d bytes", ErrBaseMismatch, delta.BaseSize)
+	}
+	if extra, _ := original.ReadAt(make([]byte, 1), int64(delta.BaseSize)); extra > 0 {
+		return fmt.Errorf("%w: original file is longer than %d bytes", ErrBaseMismatch, delta.BaseSize)
+	}
+	if delta.BaseHash != "" && hex.EncodeToString(base.Sum(nil)) != delta.BaseHash {
+		return fmt.Errorf("%w: hash differs", ErrBaseMismatch)
+	}
+	return nil
+}
+
+// Encode writes delta in compact binary form, which can be read with DecodeDelta.
+// Only Ops, sizes and hashes are encoded, Reused and Changed chunks are not. Hashes are required,
+// so delta without them (e.g. decoded from git format) can't be encoded
+func (d *Delta) Encode(w io.Writer, opts ...EncodeOption) error {
+	options := encodeOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	sealed, err := encrypted(w, options.recipients)
+	if err != nil {
+		return err
+	}
+	if options.signingKey == nil {
+		err = d.encode(sealed, options)
+	} else {
+		// whole delta is needed to sign it
+		payload := &bytes.Buffer{}
+		if err = d.encode(payload, options); err == nil {
+			err = writeSigned(sealed, payload.Bytes(), options.signingKey)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return sealed.Close()
+}
+
+func (d *Delta) encode(w io.Writer, options encodeOptions) error {
+	if options.codec == CodecNone {
+		options.mode = 0
+	}
+	if err := options.validate(); err != nil {
+		return err
+	}
+	if options.codec == CodecFlateDictionary && options.original == nil {
+		return ErrOriginalRequired
+	}
+
+	bw := bufio.NewWriter(w)
+	bw.Write(deltaMagic)
+	bw.Write([]byte{deltaVersion, byte(options.codec), byte(options.mode)})
+	// sizes and hashes are never compressed, so the delta can be matched with files without decoding it
+	writeUvarint(bw, uint64(d.BaseSize))
+	if err := writeHash(bw, d.BaseHash); err != nil {
+		return err
+	}
+	writeUvarint(bw, uint64(d.TargetSize))
+	if err := writeHash(bw, d.TargetHash); err != nil {
+		return err
+	}
+
+	body := bw
+	var stream io.WriteCloser
+	if options.mode == PerStream {
+		var err error
+		if stream, err = compressor(options.codec, bw, nil); err != nil {
+			return err
+		}
+		body = bufio.NewWriter(stream)
+	}
+
+	writeUvarint(body, uint64(len(d.Ops)))
+	// copiedEnd is end of the previously copied original data
+	copiedEnd := 0
+	for _, op := range d.Ops {
+		body.WriteByte(byte(op.Type))
+		switch op.Type {
+		case OpCopy:
+			writeUvarint(body, uint64(op.Offset))
+			writeUvarint(body, uint64(op.Length))
+			copiedEnd = op.Offset + op.Length
+		case OpInsert:
+			writeUvarint(body, uint64(len(op.Data)))
+			if options.mode == PerOp {
+				var dict []byte
+				if options.codec == CodecFlateDictionary {
+					var err error
+					if dict, err = dictionary(options.original, d.BaseSize, copiedEnd); err != nil {
+						return err
+					}
+				}
+				if err := writeCompressed(body, options.codec, op.Data, dict); err != nil {
+					return err
+				}
+				continue
+			}
+			body.Write(op.Data)
+		default:
+			return fmt.Errorf("%w: unknown op type %d", ErrInvalidDelta, op.Type)
+		}
+	}
+
+	if stream != nil {
+		if err := body.Flush(); err != nil {
+			return fmt.Errorf("failed to write delta: %w", err)
+		}
+		if err := stream.Close(); err != nil {
+			return fmt.Errorf("failed to compress delta: %w", err)
+		}
+	}
+	// bufio.Writer keeps the first error, so it's enough to check it once
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("failed to write delta: %w", err)
+	}
+
+	return nil
+}
+
+// DecodeDelta reads delta written with Delta.Encode. Compressed data is decompressed with the codec
+// recorded in the header. Encrypted delta is decrypted with WithDecryptionKey. Signed delta is verified
+// before decoding and it's rejected unless it's signed with one of WithTrustedKeys
+func DecodeDelta(r io.Reader, opts ...DecodeOption) (*Delta, error) {
+	decoding := decodeOptions{}
+	for _, opt := range opts {
+		opt(&decoding)
+	}
+
+	br, err := decrypted(bufio.NewReader(r), decoding.decryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	if br, err = verified(br, decoding.trustedKeys); err != nil {
+		return nil, err
+	}
+	header := make([]byte, len(deltaMagic)+1)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("failed to read delta header: %w", err)
+	}
+	if string(header[:len(deltaMagic)]) != string(deltaMagic) {
+		return nil, fmt.Errorf("%w: unknown format", ErrInvalidDelta)
+	}
+
+	// versions before 3 had no hashes, they were never released so they aren't decoded
+	if version := header[len(deltaMagic)]; version != deltaVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidDelta, version)
+	}
+	compression := make([]byte, 2)
+	if _, err := io.ReadFull(br, compression); err != nil {
+		return nil, fmt.Errorf("failed to read delta header: %w", err)
+	}
+	options := encodeOptions{codec: Codec(compression[0]), mode: CompressionMode(compression[1])}
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	if options.codec == CodecFlateDictionary && decoding.original == nil {
+		return nil, ErrOriginalRequired
+	}
+
+	delta := &Delta{Reused: make([]Chunk, 0), Changed: make([]Chunk, 0)}
+	if delta.BaseSize, err = readUvarint(br); err != nil {
+		return nil, err
+	}
+	if delta.BaseHash, err = readHash(br); err != nil {
+		return nil, err
+	}
+	if delta.TargetSize, err = readUvarint(br); err != nil {
+		return nil, err
+	}
+	if delta.TargetHash, err = readHash(br); err != nil {
+		return nil, err
+	}
+
+	body := br
+	if options.mode == PerStream {
+		stream, err := decompressor(options.codec, br, nil)
+		if err != nil {
+			return nil, err
+		}
+		defer stream.Close()
+		body = bufio.NewReader(stream)
+	}
+
+	count, err := readUvarint(body)
+	if err != nil {
+		return nil, err
+	}
+
+	// count comes from the input, so it doesn't decide how much is allocated upfront
+	opsCapacity := count
+	if opsCapacity > 1024 {
+		opsCapacity = 1024
+	}
+	delta.Ops = make([]Op, 0, opsCapacity)
+	// copiedEnd is end of the previously copied original data
+	copiedEnd := 0
+	for i := 0; i < count; i++ {
+		opType, err := body.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read delta: %w", err)
+		}
+		op := Op{Type: OpType(opType)}
+		switch op.Type {
+		case OpCopy:
+			if op.Offset, err = readUvarint(body); err != nil {
+				return nil, err
+			}
+			if op.Length, err = readUvarint(body); err != nil {
+				return nil, err
+			}
+			// checked once here, so consumers of decoded delta (Patch, Compose, Invert) get copies within original
+			if copyOutOfBounds(op, delta.BaseSize) {
+				return nil, fmt.Errorf("%w: copy of %d bytes at %d is out of original file", ErrInvalidDelta, op.Length, op.Offset)
+			}
+			copiedEnd = op.Offset + op.Length
+		case OpInsert:
+			if op.Length, err = readUvarint(body); err != nil {
+				return nil, err
+			}
+			if op.Length > delta.TargetSize {
+				return nil, fmt.Errorf("%w: insert of %d bytes exceeds target size", ErrInvalidDelta, op.Length)
+			}
+			if options.mode == PerOp {
+				var dict []byte
+				if options.codec == CodecFlateDictionary {
+					if dict, err = dictionary(decoding.original, delta.BaseSize, copiedEnd); err != nil {
+						return nil, err
+					}
+				}
+				if op.Data, err = readCompressed(body, options.codec, op.Length, dict); err != nil {
+					return nil, err
+				}
+				break
+			}
+			if op.Data, err = readLimited(body, op.Length); err != nil {
+				return nil, fmt.Errorf("failed to read delta: %w", err)
+			}
+		default:
+			return nil, fmt.Errorf("%w: unknown op type %d", ErrInvalidDelta, op.Type)
+		}
+		delta.Ops = append(delta.Ops, op)
+	}
+
+	return delta, nil
+}
+
+// copyOutOfBounds reports whether copy op reads outside of the original file of given size.
+// Offset and length can come from the input, so they are never added up
+func copyOutOfBounds(op Op, size int) bool {
+	return op.Offset < 0 || op.Length < 0 || op.Offset > size || op.Length > size-op.Offset
+}
+
+// appendCopy appends copy instruction, merging it with the previous one if they are adjacent in the original file
+func appendCopy(ops []Op, offset, length int) []Op {
+	if last := len(ops) - 1; last >= 0 && ops[last].Type == OpCopy && ops[last].Offset+ops[last].Length == offset {
+		ops[last].Length += length
+		return ops
+	}
+	return append(ops, Op{Type: OpCopy, Offset: offset, Length: length})
+}
+
+// appendInsert appends insert instruction, merging it with the previous insert
+func appendInsert(ops []Op, data []byte) []Op {
+	if last := len(ops) - 1; last >= 0 && ops[last].Type == OpInsert {
+		previous := ops[last].Data
+		if len(data) > 0 && cap(previous)-len(previous) >= len(data) && &previous[:len(previous)+1][len(previous)] == &data[0] {
+			// data directly follows previous data in the same array (consecutive chunks of the updated file)
+			ops[last].Data = previous[:len(previous)+len(data)]
+		} else {
+			// previous data might be shared with the updated file, so it's never appended in place
+			merged := make([]byte, 0, len(previous)+len(data))
+			ops[last].Data = append(append(merged, previous...), data...)
+		}
+		ops[last].Length = len(ops[last].Data)
+		return ops
+	}
+	return append(ops, Op{Type: OpInsert, Length: len(data), Data: data})
+}
+
+// writeHash writes length of decoded hex hash followed by its bytes. Length is always sha256.Size,
+// it's kept to allow other hashes in the future
+func writeHash(w *bufio.Writer, hash string) error {
+	decoded, err := hex.DecodeString(hash)
+	if err != nil || len(decoded) != sha256.Size {
+		return fmt.Errorf("%w: %q is not SHA-256 hash", ErrInvalidDelta, hash)
+	}
+	w.WriteByte(byte(len(decoded)))
+	w.Write(decoded)
+	return nil
+}
+
+func readHash(r *bufio.Reader) (string, error) {
+	length, err := r.ReadByte()
+	if err != nil {
+		return "", fmt.Errorf("failed to read delta: %w", err)
+	}
+	// empty hash would disable verification in Patch
+	if length != sha256.Size {
+		return "", fmt.Errorf("%w: hash of %d bytes", ErrInvalidDelta, length)
+	}
+	decoded := make([]byte, length)
+	if _, err = io.ReadFull(r, decoded); err != nil {
+		return "", fmt.Errorf("failed to read delta: %w", err)
+	}
+	return hex.EncodeToString(decoded), nil
+}
+
+// readLimited reads exactly length bytes. Length comes from the input, so buffer grows only with data
+// which is actually read, the same as ops capacity doesn't follow declared count
+func readLimited(r io.Reader, length int) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	n, err := io.CopyN(buffer, r, int64(length))
+	if err == io.EOF && n < int64(length) {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func writeUvarint(w *bufio.Writer, value uint64) {
+	buffer := make([]byte, binary.MaxVarintLen64)
+	w.Write(buffer[:binary.PutUvarint(buffer, value)])
+}
+
+func readUvarint(r *bufio.Reader) (int, error) {
+	value, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read delta: %w", err)
+	}
+	if value > uint64(maxInt) {
+		return 0, fmt.Errorf("%w: value %d is too big", ErrInvalidDelta, value)
+	}
+	return int(value), nil
+}
+
+const maxInt = int(^uint(0) >> 1)
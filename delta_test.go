@@ -0,0 +1,286 @@
+package filediff
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPatch(t *testing.T) {
+	original := randomData(1, 256*1024)
+
+	testCases := map[string]struct {
+		updated []byte
+	}{
+		"should patch unchanged file": {
+			updated: original,
+		},
+		"should patch file modified in the middle": {
+			updated: append(append(append([]byte{}, original[:100*1024]...), randomData(2, 100)...), original[101*1024:]...),
+		},
+		"should patch file with moved parts": {
+			updated: append(append([]byte{}, original[128*1024:]...), original[:128*1024]...),
+		},
+		"should patch file with repeated parts": {
+			updated: append(append([]byte{}, original...), original[:64*1024]...),
+		},
+		"should patch completely different file": {
+			updated: randomData(3, 100*1024),
+		},
+		"should patch to empty file": {
+			updated: []byte{},
+		},
+		"should patch file smaller than rolling hash window": {
+			updated: []byte("short"),
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// given
+			delta, err := Diff(original, tc.updated, 4096)
+			require.NoError(t, err)
+			encoded := &bytes.Buffer{}
+			require.NoError(t, delta.Encode(encoded))
+
+			// when
+			decoded, err := DecodeDelta(encoded)
+			require.NoError(t, err)
+			patched := &bytes.Buffer{}
+			err = Patch(bytes.NewReader(original), decoded, patched)
+
+			// then
+			require.NoError(t, err)
+			assert.Equal(t, string(tc.updated), patched.String())
+			assert.Equal(t, delta.Ops, decoded.Ops)
+		})
+	}
+
+	t.Run("should store only changed data", func(t *testing.T) {
+		// given
+		updated := append(append(append([]byte{}, original[:100*1024]...), randomData(2, 100)...), original[100*1024:]...)
+
+		// when
+		delta, err := Diff(original, updated, 4096)
+		require.NoError(t, err)
+		encoded := &bytes.Buffer{}
+		require.NoError(t, delta.Encode(encoded))
+
+		// then
+		assert.Less(t, encoded.Len(), 32*1024)
+	})
+
+	t.Run("should not patch original file of different size", func(t *testing.T) {
+		// given
+		delta, err := Diff(original, original, 4096)
+		require.NoError(t, err)
+
+		// when
+		err = Patch(bytes.NewReader(original[:1000]), delta, &bytes.Buffer{})
+
+		// then
+		assert.ErrorIs(t, err, ErrBaseMismatch)
+	})
+
+	t.Run("should not patch different original file of the same size", func(t *testing.T) {
+		// given
+		delta, err := Diff(original, original[:1000], 4096)
+		require.NoError(t, err)
+		encoded := &bytes.Buffer{}
+		require.NoError(t, delta.Encode(encoded))
+		decoded, err := DecodeDelta(encoded)
+		require.NoError(t, err)
+		different := append([]byte{}, original...)
+		different[len(different)-1]++
+		patched := &bytes.Buffer{}
+
+		// when
+		err = Patch(bytes.NewReader(different), decoded, patched)
+
+		// then
+		assert.ErrorIs(t, err, ErrBaseMismatch)
+		assert.Zero(t, patched.Len())
+	})
+
+	t.Run("should detect corrupt updated file", func(t *testing.T) {
+		// given
+		updated := append(append([]byte{}, original[:1000]...), randomData(2, 100)...)
+		delta, err := Diff(original, updated, 4096)
+		require.NoError(t, err)
+		encoded := &bytes.Buffer{}
+		require.NoError(t, delta.Encode(encoded))
+		// flip a bit of the inserted data, which is the end of the encoded delta
+		corrupted := encoded.Bytes()
+		corrupted[len(corrupted)-1] ^= 1
+		decoded, err := DecodeDelta(bytes.NewReader(corrupted))
+		require.NoError(t, err)
+
+		// when
+		err = Patch(bytes.NewReader(original), decoded, &bytes.Buffer{})
+
+		// then
+		assert.ErrorIs(t, err, ErrTargetCorrupt)
+	})
+
+	t.Run("should keep hashes of files in encoded delta", func(t *testing.T) {
+		// given
+		delta, err := Diff(original, original[:1000], 4096)
+		require.NoError(t, err)
+		encoded := &bytes.Buffer{}
+		require.NoError(t, delta.Encode(encoded, WithCompression(CodecFlate, PerStream)))
+
+		// when
+		decoded, err := DecodeDelta(encoded)
+
+		// then
+		require.NoError(t, err)
+		assert.Equal(t, fingerprint(original), decoded.BaseHash)
+		assert.Equal(t, fingerprint(original[:1000]), decoded.TargetHash)
+		assert.Equal(t, len(original), decoded.BaseSize)
+		assert.Equal(t, 1000, decoded.TargetSize)
+	})
+
+	t.Run("should reject delta of previous version without hashes", func(t *testing.T) {
+		// given
+		encoded := []byte{'F', 'D', 'L', 'T', 2, byte(CodecNone), 0, 3, 5, 2, byte(OpCopy), 0, 3, byte(OpInsert), 2, 'a', 'b'}
+
+		// when
+		_, err := DecodeDelta(bytes.NewReader(encoded))
+
+		// then
+		assert.ErrorIs(t, err, ErrInvalidDelta)
+	})
+
+	t.Run("should reject encoded delta with hash removed", func(t *testing.T) {
+		// given
+		delta, err := Diff(original, original[:1000], 4096)
+		require.NoError(t, err)
+		encoded := &bytes.Buffer{}
+		require.NoError(t, delta.Encode(encoded))
+		// header is magic, version, codec, mode and base size followed by length of the base hash
+		header := len(deltaMagic) + 3 + len(binary.AppendUvarint(nil, uint64(len(original))))
+		tampered := append(append([]byte{}, encoded.Bytes()[:header]...), 0)
+		tampered = append(tampered, encoded.Bytes()[header+1+sha256.Size:]...)
+
+		// when
+		_, err = DecodeDelta(bytes.NewReader(tampered))
+
+		// then
+		assert.ErrorIs(t, err, ErrInvalidDelta)
+	})
+
+	t.Run("should not encode delta without hashes", func(t *testing.T) {
+		// given
+		delta := &Delta{Ops: []Op{{Type: OpInsert, Length: 2, Data: []byte("ab")}}, TargetSize: 2}
+
+		// when
+		err := delta.Encode(&bytes.Buffer{})
+
+		// then
+		assert.ErrorIs(t, err, ErrInvalidDelta)
+	})
+
+	t.Run("should not allocate memory for declared size of insert", func(t *testing.T) {
+		for name, compression := range map[string][]byte{"raw": {byte(CodecNone), 0}, "per op": {byte(CodecFlate), byte(PerOp)}} {
+			t.Run(name, func(t *testing.T) {
+				// given
+				hash := append([]byte{sha256.Size}, make([]byte, sha256.Size)...)
+				encoded := append([]byte{'F', 'D', 'L', 'T', deltaVersion}, compression...)
+				encoded = binary.AppendUvarint(append(append(encoded, 0), hash...), 1<<40)
+				encoded = binary.AppendUvarint(append(append(encoded, hash...), 1, byte(OpInsert)), 1<<40)
+				encoded = append(encoded, rawData, 'a', 'b')
+
+				// when
+				_, err := DecodeDelta(bytes.NewReader(encoded))
+
+				// then
+				assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+			})
+		}
+	})
+
+	t.Run("should reject copy out of original file", func(t *testing.T) {
+		// given
+		delta := &Delta{
+			Ops:        []Op{{Type: OpCopy, Offset: math.MaxInt, Length: 1}},
+			BaseSize:   len(original),
+			TargetSize: 1,
+			BaseHash:   fingerprint(original),
+			TargetHash: fingerprint(original[:1]),
+		}
+		encoded := &bytes.Buffer{}
+		require.NoError(t, delta.Encode(encoded))
+
+		// when
+		patchErr := Patch(bytes.NewReader(original), delta, &bytes.Buffer{})
+		_, decodeErr := DecodeDelta(encoded)
+
+		// then
+		assert.ErrorIs(t, patchErr, ErrInvalidDelta)
+		assert.ErrorIs(t, decodeErr, ErrInvalidDelta)
+	})
+
+	t.Run("should not decode unknown format", func(t *testing.T) {
+		_, err := DecodeDelta(bytes.NewReader([]byte("something else")))
+		assert.ErrorIs(t, err, ErrInvalidDelta)
+	})
+}
+
+func TestDiffExtendsMatches(t *testing.T) {
+	original := randomData(1, 256*1024)
+
+	testCases := map[string]struct {
+		edits []int
+		// maxLiteral is upper bound of literal data in delta
+		maxLiteral int
+	}{
+		"should send only edited bytes": {
+			edits:      []int{1000, 70 * 1024, 200 * 1024},
+			maxLiteral: 3,
+		},
+		"should send edited byte at the beginning of the file": {
+			edits:      []int{0},
+			maxLiteral: 1,
+		},
+		"should send edited byte at the end of the file": {
+			edits:      []int{len(original) - 1},
+			maxLiteral: 1,
+		},
+		"should send bytes between close edits": {
+			edits:      []int{1000, 1100},
+			maxLiteral: 101,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// given
+			updated := append([]byte{}, original...)
+			for _, offset := range tc.edits {
+				updated[offset] ^= 0xff
+			}
+
+			// when
+			delta, err := Diff(original, updated, 4096)
+
+			// then
+			require.NoError(t, err)
+			literal := 0
+			for _, op := range delta.Ops {
+				if op.Type == OpInsert {
+					literal += op.Length
+				}
+			}
+			assert.LessOrEqual(t, literal, tc.maxLiteral)
+			patched := &bytes.Buffer{}
+			require.NoError(t, Patch(bytes.NewReader(original), delta, patched))
+			assert.Equal(t, string(updated), patched.String())
+		})
+	}
+}
@@ -0,0 +1,371 @@
+package filediff
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// encryptedMagic starts every encrypted stream. Stream is a header with data key wrapped for every recipient,
+// followed by segments of data sealed with AES-256-GCM. Segments are numbered and the last one is marked in its
+// nonce (STREAM construction), so reordered, dropped or truncated segments are detected while decrypting incrementally
+var encryptedMagic = []byte("FDEC")
+
+const (
+	encryptedVersion = 1
+	// segmentSize is size of plain data sealed in a single segment
+	segmentSize = 64 * 1024
+	// noncePrefixSize is size of random part of segment nonces, the rest is segment number and the last segment flag
+	noncePrefixSize = 7
+	// recipientIDSize is number of bytes of recipient's public key hash used as its ID
+	recipientIDSize = 8
+	dataKeySize     = 32
+	// wrappedKeySize is size of data key sealed for a recipient
+	wrappedKeySize = dataKeySize + 16
+	maxRecipients  = math.MaxUint8
+)
+
+var (
+	// ErrNotRecipient is returned when data isn't encrypted for the key it's decrypted with
+	ErrNotRecipient = errors.New("data isn't encrypted for the key")
+	// ErrDecryption is returned when encrypted data was modified, reordered or truncated
+	ErrDecryption = errors.New("failed to authenticate encrypted data")
+)
+
+// WithEncryption encrypts encoded data for recipients, any of them can decrypt it with its private X25519 key.
+// Signed data is signed first, so signature is hidden as well
+func WithEncryption(recipients ...*ecdh.PublicKey) EncodeOption {
+	return func(o *encodeOptions) {
+		o.recipients = recipients
+	}
+}
+
+// WithDecryptionKey decrypts data encrypted with WithEncryption. Data is decrypted incrementally as it's decoded
+func WithDecryptionKey(key *ecdh.PrivateKey) DecodeOption {
+	return func(o *decodeOptions) {
+		o.decryptionKey = key
+	}
+}
+
+// NewEncrypter returns writer which encrypts data written to it for recipients and writes it to w.
+// Close must be called to seal the last segment, it doesn't close w
+func NewEncrypter(w io.Writer, recipients ...*ecdh.PublicKey) (io.WriteCloser, error) {
+	if len(recipients) == 0 || len(recipients) > maxRecipients {
+		return nil, fmt.Errorf("encryption needs 1 to %d recipients, got %d", maxRecipients, len(recipients))
+	}
+
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	dataKey := make([]byte, dataKeySize)
+	noncePrefix := make([]byte, noncePrefixSize)
+	if _, err = rand.Read(dataKey); err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	if _, err = rand.Read(noncePrefix); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	header := append(append([]byte{}, encryptedMagic...), encryptedVersion)
+	header = append(append(append(header, ephemeral.PublicKey().Bytes()...), noncePrefix...), byte(len(recipients)))
+	for _, recipient := range recipients {
+		keyWrap, err := keyWrapCipher(ephemeral, ephemeral.PublicKey(), recipient)
+		if err != nil {
+			return nil, err
+		}
+		header = append(header, recipientID(recipient)...)
+		header = keyWrap.Seal(header, make([]byte, keyWrap.NonceSize()), dataKey, nil)
+	}
+	if _, err = w.Write(header); err != nil {
+		return nil, fmt.Errorf("failed to write encrypted data: %w", err)
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &encrypter{
+		w:      w,
+		stream: newSegmentStream(aead, noncePrefix, header),
+		buffer: make([]byte, 0, segmentSize),
+	}, nil
+}
+
+// NewDecrypter returns reader of data encrypted with NewEncrypter for the public part of key
+func NewDecrypter(r io.Reader, key *ecdh.PrivateKey) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	// magic, version, ephemeral public key, nonce prefix and number of recipients
+	header := make([]byte, len(encryptedMagic)+1+32+noncePrefixSize+1)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("failed to read encrypted data: %w", err)
+	}
+	if !bytes.Equal(header[:len(encryptedMagic)], encryptedMagic) {
+		return nil, fmt.Errorf("%w: data isn't encrypted", ErrNotRecipient)
+	}
+	if version := header[len(encryptedMagic)]; version != encryptedVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrDecryption, version)
+	}
+	ephemeralStart := len(encryptedMagic) + 1
+	ephemeral, err := ecdh.X25519().NewPublicKey(header[ephemeralStart : ephemeralStart+32])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid key: %v", ErrDecryption, err)
+	}
+	noncePrefix := header[ephemeralStart+32 : ephemeralStart+32+noncePrefixSize]
+
+	recipients := make([]byte, int(header[len(header)-1])*(recipientIDSize+wrappedKeySize))
+	if _, err = io.ReadFull(br, recipients); err != nil {
+		return nil, fmt.Errorf("failed to read encrypted data: %w", err)
+	}
+	header = append(header, recipients...)
+
+	id := recipientID(key.PublicKey())
+	var dataKey []byte
+	for i := 0; i < len(recipients) && dataKey == nil; i += recipientIDSize + wrappedKeySize {
+		if !bytes.Equal(recipients[i:i+recipientIDSize], id) {
+			continue
+		}
+		keyWrap, err := keyWrapCipher(key, ephemeral, key.PublicKey())
+		if err != nil {
+			return nil, err
+		}
+		wrapped := recipients[i+recipientIDSize : i+recipientIDSize+wrappedKeySize]
+		if dataKey, err = keyWrap.Open(nil, make([]byte, keyWrap.NonceSize()), wrapped, nil); err != nil {
+			return nil, fmt.Errorf("%w: wrapped key", ErrDecryption)
+		}
+	}
+	if dataKey == nil {
+		return nil, ErrNotRecipient
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &decrypter{
+		r:      br,
+		stream: newSegmentStream(aead, noncePrefix, header),
+		sealed: make([]byte, segmentSize+aead.Overhead()),
+	}, nil
+}
+
+// segmentStream seals and opens consecutive segments. Every segment is authenticated together with the header
+type segmentStream struct {
+	aead    cipher.AEAD
+	nonce   []byte
+	counter uint32
+	aad     []byte
+}
+
+func newSegmentStream(aead cipher.AEAD, noncePrefix, header []byte) *segmentStream {
+	headerHash := sha256.Sum256(header)
+	nonce := make([]byte, aead.NonceSize())
+	copy(nonce, noncePrefix)
+	return &segmentStream{aead: aead, nonce: nonce, aad: headerHash[:]}
+}
+
+// next returns nonce of the next segment
+func (s *segmentStream) next(last bool) ([]byte, error) {
+	if s.counter == math.MaxUint32 {
+		return nil, errors.New("too much data for a single encrypted stream")
+	}
+	binary.BigEndian.PutUint32(s.nonce[noncePrefixSize:], s.counter)
+	s.nonce[len(s.nonce)-1] = 0
+	if last {
+		s.nonce[len(s.nonce)-1] = 1
+	}
+	s.counter++
+	return s.nonce, nil
+}
+
+type encrypter struct {
+	w      io.Writer
+	stream *segmentStream
+	buffer []byte
+	sealed []byte
+	closed bool
+}
+
+func (e *encrypter) Write(data []byte) (int, error) {
+	if e.closed {
+		return 0, errors.New("write to closed encrypter")
+	}
+
+	written := 0
+	for len(data) > 0 {
+		// full segment is sealed only when there is more data, the last one has to be marked
+		if len(e.buffer) == segmentSize {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buffer[len(e.buffer):segmentSize], data)
+		e.buffer = e.buffer[:len(e.buffer)+n]
+		data = data[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close seals the last segment, it's written even when it's empty
+func (e *encrypter) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	return e.seal(true)
+}
+
+func (e *encrypter) seal(last bool) error {
+	nonce, err := e.stream.next(last)
+	if err != nil {
+		return err
+	}
+	e.sealed = e.stream.aead.Seal(e.sealed[:0], nonce, e.buffer, e.stream.aad)
+	e.buffer = e.buffer[:0]
+	if _, err = e.w.Write(e.sealed); err != nil {
+		return fmt.Errorf("failed to write encrypted data: %w", err)
+	}
+	return nil
+}
+
+type decrypter struct {
+	r      *bufio.Reader
+	stream *segmentStream
+	sealed []byte
+	plain  []byte
+	done   bool
+	err    error
+}
+
+func (d *decrypter) Read(data []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.done {
+			return 0, io.EOF
+		}
+		d.err = d.open()
+	}
+	n := copy(data, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+// open reads and opens the next segment, it's the last one when nothing follows it
+func (d *decrypter) open() error {
+	n, err := io.ReadFull(d.r, d.sealed)
+	last := false
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		last = true
+	case err != nil:
+		return fmt.Errorf("failed to read encrypted data: %w", err)
+	default:
+		if _, err = d.r.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return fmt.Errorf("failed to read encrypted data: %w", err)
+		}
+	}
+
+	segment := d.stream.counter
+	nonce, err := d.stream.next(last)
+	if err != nil {
+		return err
+	}
+	if d.plain, err = d.stream.aead.Open(d.plain[:0], nonce, d.sealed[:n], d.stream.aad); err != nil {
+		return fmt.Errorf("%w: segment %d", ErrDecryption, segment)
+	}
+	d.done = last
+	return nil
+}
+
+// keyWrapCipher returns cipher which seals data key for recipient. Its key is derived from X25519 shared secret
+// of private key and peer, bound to both public keys of the exchange
+func keyWrapCipher(private *ecdh.PrivateKey, ephemeral, recipient *ecdh.PublicKey) (cipher.AEAD, error) {
+	secret, err := private.ECDH(peer(private, ephemeral, recipient))
+	if err != nil {
+		return nil, fmt.Errorf("failed to exchange keys: %w", err)
+	}
+	salt := append(append([]byte{}, ephemeral.Bytes()...), recipient.Bytes()...)
+	return newGCM(deriveKey(secret, salt, []byte("file-diff key wrap")))
+}
+
+// peer returns public key of the other side of the exchange
+func peer(private *ecdh.PrivateKey, ephemeral, recipient *ecdh.PublicKey) *ecdh.PublicKey {
+	if private.PublicKey().Equal(ephemeral) {
+		return recipient
+	}
+	return ephemeral
+}
+
+// deriveKey is HKDF-SHA256 (RFC 5869) producing a single 32 bytes key
+func deriveKey(secret, salt, info []byte) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write(info)
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
+
+func recipientID(key *ecdh.PublicKey) []byte {
+	keyHash := sha256.Sum256(key.Bytes())
+	return keyHash[:recipientIDSize]
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return aead, nil
+}
+
+// encrypted returns writer encrypting data for recipients, or w itself when there are none.
+// Returned writer must be closed
+func encrypted(w io.Writer, recipients []*ecdh.PublicKey) (io.WriteCloser, error) {
+	if len(recipients) == 0 {
+		return nopWriteCloser{w}, nil
+	}
+	return NewEncrypter(w, recipients...)
+}
+
+// decrypted returns reader of decrypted data read by r, or r itself when there is no key
+func decrypted(r *bufio.Reader, key *ecdh.PrivateKey) (*bufio.Reader, error) {
+	if key == nil {
+		if magic, _ := r.Peek(len(encryptedMagic)); bytes.Equal(magic, encryptedMagic) {
+			return nil, fmt.Errorf("%w: no decryption key", ErrNotRecipient)
+		}
+		return r, nil
+	}
+	decrypter, err := NewDecrypter(r, key)
+	if err != nil {
+		return nil, err
+	}
+	return bufio.NewReader(decrypter), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,207 @@
+package filediff
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryption(t *testing.T) {
+	recipient, other := testRecipient(t), testRecipient(t)
+
+	testCases := map[string]struct {
+		data []byte
+	}{
+		"should encrypt empty data": {
+			data: []byte{},
+		},
+		"should encrypt data shorter than segment": {
+			data: randomData(1, 1000),
+		},
+		"should encrypt data of exactly one segment": {
+			data: randomData(2, segmentSize),
+		},
+		"should encrypt data of many segments": {
+			data: randomData(3, 3*segmentSize+5),
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// given
+			encrypted := &bytes.Buffer{}
+			encrypter, err := NewEncrypter(encrypted, other.PublicKey(), recipient.PublicKey())
+			require.NoError(t, err)
+			_, err = encrypter.Write(tc.data)
+			require.NoError(t, err)
+			require.NoError(t, encrypter.Close())
+
+			// when
+			decrypter, err := NewDecrypter(encrypted, recipient)
+			require.NoError(t, err)
+			decrypted, err := io.ReadAll(decrypter)
+
+			// then
+			require.NoError(t, err)
+			assert.Equal(t, string(tc.data), string(decrypted))
+		})
+	}
+
+	data := randomData(4, 3*segmentSize)
+	encrypted := &bytes.Buffer{}
+	encrypter, err := NewEncrypter(encrypted, recipient.PublicKey())
+	require.NoError(t, err)
+	_, err = encrypter.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, encrypter.Close())
+	sealedSegmentSize := segmentSize + 16
+	headerSize := encrypted.Len() - 3*sealedSegmentSize
+
+	t.Run("should decrypt data incrementally", func(t *testing.T) {
+		// given only header and two segments are available yet
+		available := encrypted.Bytes()[:headerSize+2*sealedSegmentSize]
+		r := io.MultiReader(bytes.NewReader(available), iotest.ErrReader(errors.New("not available yet")))
+
+		// when
+		decrypter, err := NewDecrypter(r, recipient)
+		require.NoError(t, err)
+		decrypted := make([]byte, segmentSize)
+		_, err = io.ReadFull(decrypter, decrypted)
+
+		// then
+		require.NoError(t, err)
+		assert.Equal(t, data[:segmentSize], decrypted)
+	})
+
+	t.Run("should not decrypt data for other recipient", func(t *testing.T) {
+		// when
+		_, err := NewDecrypter(bytes.NewReader(encrypted.Bytes()), other)
+
+		// then
+		assert.ErrorIs(t, err, ErrNotRecipient)
+	})
+
+	tamperingCases := map[string]struct {
+		tamper func(encrypted []byte) []byte
+	}{
+		"should detect modified segment": {
+			tamper: func(encrypted []byte) []byte {
+				tampered := append([]byte{}, encrypted...)
+				tampered[headerSize+sealedSegmentSize+10] ^= 1
+				return tampered
+			},
+		},
+		"should detect data truncated at segment boundary": {
+			tamper: func(encrypted []byte) []byte {
+				return encrypted[:headerSize+2*sealedSegmentSize]
+			},
+		},
+		"should detect reordered segments": {
+			tamper: func(encrypted []byte) []byte {
+				tampered := append([]byte{}, encrypted[:headerSize]...)
+				tampered = append(tampered, encrypted[headerSize+sealedSegmentSize:headerSize+2*sealedSegmentSize]...)
+				tampered = append(tampered, encrypted[headerSize:headerSize+sealedSegmentSize]...)
+				return append(tampered, encrypted[headerSize+2*sealedSegmentSize:]...)
+			},
+		},
+		"should detect modified header": {
+			tamper: func(encrypted []byte) []byte {
+				tampered := append([]byte{}, encrypted...)
+				// last byte of the nonce prefix
+				tampered[len(encryptedMagic)+1+32+noncePrefixSize-1] ^= 1
+				return tampered
+			},
+		},
+	}
+
+	for name, tc := range tamperingCases {
+		t.Run(name, func(t *testing.T) {
+			// given
+			decrypter, err := NewDecrypter(bytes.NewReader(tc.tamper(encrypted.Bytes())), recipient)
+			require.NoError(t, err)
+
+			// when
+			_, err = io.ReadAll(decrypter)
+
+			// then
+			assert.ErrorIs(t, err, ErrDecryption)
+		})
+	}
+}
+
+func TestEncryptedDelta(t *testing.T) {
+	original := randomData(1, 256*1024)
+	updated := append(append([]byte{}, original[:100*1024]...), randomData(2, 100*1024)...)
+	delta, err := Diff(original, updated, 4096)
+	require.NoError(t, err)
+	recipient, signingKey := testRecipient(t), testKey(1)
+	keys := keyRing(t, signingKey)
+
+	t.Run("should patch signed and encrypted delta", func(t *testing.T) {
+		// given
+		encoded := &bytes.Buffer{}
+		require.NoError(t, delta.Encode(encoded, WithSigningKey(signingKey), WithEncryption(recipient.PublicKey())))
+
+		// when
+		decoded, err := DecodeDelta(encoded, WithDecryptionKey(recipient), WithTrustedKeys(keys))
+		require.NoError(t, err)
+		patched := &bytes.Buffer{}
+		err = Patch(bytes.NewReader(original), decoded, patched)
+
+		// then
+		require.NoError(t, err)
+		assert.Equal(t, string(updated), patched.String())
+	})
+
+	t.Run("should not reveal delta content", func(t *testing.T) {
+		// given
+		encoded := &bytes.Buffer{}
+
+		// when
+		err := delta.Encode(encoded, WithEncryption(recipient.PublicKey()))
+
+		// then
+		require.NoError(t, err)
+		assert.False(t, bytes.Contains(encoded.Bytes(), updated[len(updated)-64:]))
+	})
+
+	t.Run("should not decode encrypted delta without key", func(t *testing.T) {
+		// given
+		encoded := &bytes.Buffer{}
+		require.NoError(t, delta.Encode(encoded, WithEncryption(recipient.PublicKey())))
+
+		// when
+		_, err := DecodeDelta(encoded)
+
+		// then
+		assert.ErrorIs(t, err, ErrNotRecipient)
+	})
+
+	t.Run("should read encrypted signature", func(t *testing.T) {
+		// given
+		chunks, err := Split(original, 4096)
+		require.NoError(t, err)
+		encrypted := &bytes.Buffer{}
+		require.NoError(t, WriteSignature(encrypted, chunks, WithEncryption(recipient.PublicKey())))
+
+		// when
+		read, err := ReadSignature(encrypted, WithDecryptionKey(recipient))
+
+		// then
+		require.NoError(t, err)
+		assert.Equal(t, withoutChunksData(chunks), read)
+	})
+}
+
+func testRecipient(t *testing.T) *ecdh.PrivateKey {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	return key
+}
@@ -0,0 +1,89 @@
+package filediff
+
+import "index/suffixarray"
+
+// WithExactMatching replaces content defined chunk matching of Ops with exact matching: suffix array of the original
+// file is built and for every position of the updated file the longest original match is copied. It produces byte
+// granular, close to minimal deltas, but it's much slower and needs memory for the index, so it's meant for files
+// up to a few hundred MB where delta size matters more than speed. WithRefinement and WithResemblance only improve
+// chunk matched Ops, so they are ignored when combined with it. Reused and Changed chunks stay the same
+func WithExactMatching() DiffOption {
+	return func(o *diffOptions) {
+		o.exact = true
+	}
+}
+
+// exactOps greedily copies the longest match in the original file for every position of updated data.
+// Matches shorter than minRefinedMatch are sent as literal data
+func exactOps(original, updated []byte) []Op {
+	ops := make([]Op, 0)
+	if len(original) < minRefinedMatch {
+		if len(updated) > 0 {
+			ops = appendInsert(ops, updated)
+		}
+		return ops
+	}
+
+	index := suffixarray.New(original)
+	literalStart := 0
+	for position := 0; position+minRefinedMatch <= len(updated); {
+		offset, length := longestMatch(index, updated[position:])
+		if length < minRefinedMatch {
+			position++
+			continue
+		}
+
+		if position > literalStart {
+			ops = appendInsert(ops, updated[literalStart:position])
+		}
+		ops = appendCopy(ops, offset, length)
+		position += length
+		literalStart = position
+	}
+	if literalStart < len(updated) {
+		ops = appendInsert(ops, updated[literalStart:])
+	}
+
+	return ops
+}
+
+// longestMatch returns offset and length of the longest prefix of data found in the indexed original file.
+// Prefix of a match is a match as well, so the length is searched exponentially and then with bisection
+func longestMatch(index *suffixarray.Index, data []byte) (int, int) {
+	lookup := func(length int) (int, bool) {
+		offsets := index.Lookup(data[:length], 1)
+		if len(offsets) == 0 {
+			return 0, false
+		}
+		return offsets[0], true
+	}
+
+	offset, ok := lookup(minRefinedMatch)
+	if !ok {
+		return 0, 0
+	}
+
+	// matched is the longest length known to match, missing the shortest one known not to match
+	matched, missing := minRefinedMatch, len(data)+1
+	for length := 2 * minRefinedMatch; matched < len(data); length *= 2 {
+		if length > len(data) {
+			length = len(data)
+		}
+		matchOffset, ok := lookup(length)
+		if !ok {
+			missing = length
+			break
+		}
+		offset, matched = matchOffset, length
+	}
+	for missing-matched > 1 {
+		length := (matched + missing) / 2
+		if matchOffset, ok := lookup(length); ok {
+			offset, matched = matchOffset, length
+		} else {
+			missing = length
+		}
+	}
+
+	return offset, matched
+}
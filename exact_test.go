@@ -0,0 +1,90 @@
+package filediff
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExactMatching(t *testing.T) {
+	original := randomData(1, 256*1024)
+	scattered := append([]byte{}, original...)
+	edits := 0
+	for i := 1000; i < len(scattered); i += 10 * 1024 {
+		scattered[i] ^= 0xff
+		edits++
+	}
+	record := append([]byte{}, original[10*1024:14*1024]...)
+	for i := 100; i < len(record); i += 700 {
+		record[i] ^= 0xff
+	}
+	moved := append(append(append([]byte{}, original[:10*1024]...), original[14*1024:200*1024]...), record...)
+
+	testCases := map[string]struct {
+		original []byte
+		updated  []byte
+		// maxLiteral is upper bound of literal data in delta
+		maxLiteral int
+	}{
+		"should send only edited bytes": {
+			original:   original,
+			updated:    scattered,
+			maxLiteral: edits,
+		},
+		"should copy edited record moved to a different position": {
+			original:   original,
+			updated:    moved,
+			maxLiteral: 6,
+		},
+		"should send completely different data": {
+			original:   original,
+			updated:    randomData(2, 1024),
+			maxLiteral: 1024,
+		},
+		"should send data to empty original": {
+			original:   []byte{},
+			updated:    []byte("data"),
+			maxLiteral: 4,
+		},
+		"should produce empty file": {
+			original:   original,
+			updated:    []byte{},
+			maxLiteral: 0,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// when
+			delta, err := Diff(tc.original, tc.updated, 1024, WithExactMatching())
+
+			// then
+			require.NoError(t, err)
+			literal := 0
+			for _, op := range delta.Ops {
+				if op.Type == OpInsert {
+					literal += op.Length
+				}
+			}
+			assert.LessOrEqual(t, literal, tc.maxLiteral)
+			patched := &bytes.Buffer{}
+			require.NoError(t, Patch(bytes.NewReader(tc.original), delta, patched))
+			assert.Equal(t, string(tc.updated), patched.String())
+		})
+	}
+
+	t.Run("should ignore refinement and resemblance", func(t *testing.T) {
+		// given
+		exact, err := Diff(original, moved, 1024, WithExactMatching())
+		require.NoError(t, err)
+
+		// when
+		combined, err := Diff(original, moved, 1024, WithExactMatching(), WithRefinement(DefaultRefinementEffort), WithResemblance())
+
+		// then
+		require.NoError(t, err)
+		assert.Equal(t, exact, combined)
+	})
+}
@@ -18,6 +18,16 @@ type Delta struct {
 	Reused []Chunk
 	// Changed chunks which has been modified or added. Chunks which needs to be sync with original file chunks
 	Changed []Chunk
+	// Ops instructions which applied in order on the original file produce the updated file (see Patch)
+	Ops []Op
+	// BaseSize size of the original file
+	BaseSize int
+	// TargetSize size of the updated file
+	TargetSize int
+	// BaseHash SHA-256 of the original file, hex encoded. It's empty when unknown (delta decoded from git format)
+	BaseHash string
+	// TargetHash SHA-256 of the updated file, hex encoded. It's empty when unknown
+	TargetHash string
 }
 
 // Chunk represents a portion of the file
@@ -34,11 +44,23 @@ type Chunk struct {
 
 type signature map[string]Chunk
 
+type diffOptions struct {
+	// refinementEffort limits byte comparisons of refinement of a single changed region, 0 disables refinement
+	refinementEffort int
+	// resemblance enables encoding of changed data against similar original chunks
+	resemblance bool
+	// exact replaces chunk matching of ops with exact matching on suffix array
+	exact bool
+}
+
+// DiffOption configures FileDiff and Diff
+type DiffOption func(*diffOptions)
+
 // FileDiff is a file chunking function based on rolling hash algorithm
 // which returns Delta between two files which can be used to apply patch on original file.
 // It requires to provide two files (os.File) original and updated and chunkSize which needs to be
 // integer equal to power of two. Files needs to be created on the caller side (same as proper file closing)
-func FileDiff(original, updated *os.File, chunkSize uint64) (*Delta, error) {
+func FileDiff(original, updated *os.File, chunkSize uint64, opts ...DiffOption) (*Delta, error) {
 	if !isPowerOfTwo(chunkSize) {
 		return nil, errors.New("chunkSize parameter must be a power of two")
 	}
@@ -47,25 +69,74 @@ func FileDiff(original, updated *os.File, chunkSize uint64) (*Delta, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to read file: %w", err)
 	}
-	originalFileSignature := createSignature(originalData, chunkSize)
 
 	updatedFileData, err := readFile(updated)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read file: %w", err)
 	}
 
-	delta := getDelta(originalFileSignature, updatedFileData, chunkSize)
+	return Diff(originalData, updatedFileData, chunkSize, opts...)
+}
+
+// Diff is FileDiff for data which is already in memory
+func Diff(original, updated []byte, chunkSize uint64, opts ...DiffOption) (*Delta, error) {
+	if !isPowerOfTwo(chunkSize) {
+		return nil, errors.New("chunkSize parameter must be a power of two")
+	}
+	options := diffOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	originalSignature := createSignature(original, chunkSize)
+	updatedChunks := splitChunks(updated, chunkSize)
+	delta := getDelta(originalSignature, updatedChunks, len(updated))
+	delta.BaseSize = len(original)
+	delta.BaseHash, delta.TargetHash = fingerprint(original), fingerprint(updated)
+	// exact matching doesn't need chunk ops, refinement and resemblance only improve them
+	if options.exact {
+		delta.Ops = exactOps(original, updated)
+		return delta, nil
+	}
+	delta.Ops = chunkOps(originalSignature, updatedChunks, original)
+	// moved data is resembled first, so refinement of neighbouring regions gets only what is left
+	if options.resemblance {
+		effort := options.refinementEffort
+		if effort <= 0 {
+			effort = DefaultRefinementEffort
+		}
+		delta.Ops = resemble(delta.Ops, originalSignature, original, chunkSize, effort)
+	}
+	if options.refinementEffort > 0 {
+		delta.Ops = refine(delta.Ops, original, options.refinementEffort)
+	}
 
 	return delta, nil
 }
 
-func getDelta(originalFileSignature signature, updatedFileData []byte, chunkSize uint64) *Delta {
-	updatedFileSignature := createSignature(updatedFileData, chunkSize)
+// Split splits data into content defined chunks, same as FileDiff does, and returns them in the order
+// they appear in data. It requires chunkSize which needs to be integer equal to power of two
+func Split(data []byte, chunkSize uint64) ([]Chunk, error) {
+	if !isPowerOfTwo(chunkSize) {
+		return nil, errors.New("chunkSize parameter must be a power of two")
+	}
+
+	return splitChunks(data, chunkSize), nil
+}
+
+// getDelta returns delta with Reused and Changed chunks of the updated file, without Ops
+func getDelta(originalFileSignature signature, updatedFileChunks []Chunk, updatedFileSize int) *Delta {
 	reusedFileChunks := make([]Chunk, 0)
 	changedFileChunks := make([]Chunk, 0)
+	seen := make(map[string]struct{}, len(updatedFileChunks))
 
-	for sigHash, updatedFileChunk := range updatedFileSignature {
-		if chunk, ok := originalFileSignature[sigHash]; ok {
+	for _, updatedFileChunk := range updatedFileChunks {
+		chunk, reused := originalFileSignature[updatedFileChunk.Hash]
+		if _, ok := seen[updatedFileChunk.Hash]; ok {
+			continue
+		}
+		seen[updatedFileChunk.Hash] = struct{}{}
+		if reused {
 			reusedFileChunks = append(reusedFileChunks, chunk)
 			continue
 		}
@@ -74,13 +145,116 @@ func getDelta(originalFileSignature signature, updatedFileData []byte, chunkSize
 	}
 
 	return &Delta{
-		Reused:  reusedFileChunks,
-		Changed: changedFileChunks,
+		Reused:     reusedFileChunks,
+		Changed:    changedFileChunks,
+		TargetSize: updatedFileSize,
+	}
+}
+
+// chunkOps copies chunks of the updated file found in the original file and inserts the rest
+func chunkOps(originalFileSignature signature, updatedFileChunks []Chunk, originalFileData []byte) []Op {
+	ops := make([]Op, 0)
+	for _, updatedFileChunk := range updatedFileChunks {
+		if chunk, reused := originalFileSignature[updatedFileChunk.Hash]; reused {
+			ops = appendCopy(ops, chunk.Offset, chunk.Length)
+		} else {
+			ops = appendInsert(ops, updatedFileChunk.Data)
+		}
+	}
+
+	return extendMatches(ops, originalFileData)
+}
+
+// extendMatches extends every copy backwards and forwards byte by byte, as long as surrounding inserted data
+// is the same as original data around the copied part. Matching chunk is often surrounded by unchanged bytes
+// up to the actual edit, so this shrinks literal data of small edits
+func extendMatches(ops []Op, original []byte) []Op {
+	// beginning and end of the file are matches of their own, edit at the start of the file
+	// shouldn't make all data before it literal
+	if len(ops) > 0 && ops[0].Type == OpInsert {
+		inserted := ops[0].Data
+		n := 0
+		for n < len(inserted) && n < len(original) && inserted[n] == original[n] {
+			n++
+		}
+		if n > 0 {
+			ops = append([]Op{{Type: OpCopy, Offset: 0, Length: n}, {Type: OpInsert, Length: len(inserted) - n, Data: inserted[n:]}}, ops[1:]...)
+		}
 	}
+	if last := len(ops) - 1; last >= 0 && ops[last].Type == OpInsert {
+		inserted := ops[last].Data
+		n := 0
+		for n < len(inserted) && n < len(original) && inserted[len(inserted)-1-n] == original[len(original)-1-n] {
+			n++
+		}
+		if n > 0 {
+			ops[last].Data, ops[last].Length = inserted[:len(inserted)-n], len(inserted)-n
+			ops = append(ops, Op{Type: OpCopy, Offset: len(original) - n, Length: n})
+		}
+	}
+
+	for i := range ops {
+		if ops[i].Type != OpCopy {
+			continue
+		}
+		if i > 0 && ops[i-1].Type == OpInsert {
+			inserted := ops[i-1].Data
+			n := 0
+			for n < len(inserted) && ops[i].Offset-n > 0 && inserted[len(inserted)-1-n] == original[ops[i].Offset-n-1] {
+				n++
+			}
+			ops[i-1].Data, ops[i-1].Length = inserted[:len(inserted)-n], len(inserted)-n
+			ops[i].Offset -= n
+			ops[i].Length += n
+		}
+		if i+1 < len(ops) && ops[i+1].Type == OpInsert {
+			inserted := ops[i+1].Data
+			end := ops[i].Offset + ops[i].Length
+			n := 0
+			for n < len(inserted) && end+n < len(original) && inserted[n] == original[end+n] {
+				n++
+			}
+			ops[i+1].Data, ops[i+1].Length = inserted[n:], len(inserted)-n
+			ops[i].Length += n
+		}
+	}
+
+	// inserts might have been consumed completely, so copies around them could be merged now
+	extended := make([]Op, 0, len(ops))
+	for _, op := range ops {
+		switch {
+		case op.Type == OpCopy:
+			extended = appendCopy(extended, op.Offset, op.Length)
+		case op.Length > 0:
+			extended = appendInsert(extended, op.Data)
+		}
+	}
+
+	return extended
 }
 
 func createSignature(data []byte, chunkSize uint64) signature {
 	signatureChunks := make(signature)
+	for _, chunk := range splitChunks(data, chunkSize) {
+		if _, ok := signatureChunks[chunk.Hash]; !ok {
+			signatureChunks[chunk.Hash] = chunk
+		}
+	}
+
+	return signatureChunks
+}
+
+// splitChunks splits data into content defined chunks and returns them in the order
+// they appear in data. Same chunk might be returned more than once
+func splitChunks(data []byte, chunkSize uint64) []Chunk {
+	chunks := make([]Chunk, 0)
+	if len(data) == 0 {
+		return chunks
+	}
+	// rolling hash needs at least one full window, such small data is a single chunk
+	if len(data) <= hash.WindowSize {
+		return append(chunks, newChunk(data, 0))
+	}
 
 	buzHash := hash.NewBuzHash()
 	buzHash.ResetHash(data, hash.WindowSize)
@@ -100,33 +274,35 @@ func createSignature(data []byte, chunkSize uint64) signature {
 			newBytePosition = i + hash.WindowSize
 		}
 		currentHash := buzHash.RollingHash(data[i], data[newBytePosition])
-		if shouldSplit(currentHash, mask) {
-			addNewChunkToSignature(data[previousSplitPosition:i], previousSplitPosition, signatureChunks)
+		if shouldSplit(currentHash, mask) && i > previousSplitPosition {
+			chunks = append(chunks, newChunk(data[previousSplitPosition:i], previousSplitPosition))
 			previousSplitPosition = i
 		}
 
 		// if last element
 		if i == len(data)-1 {
-			addNewChunkToSignature(data[previousSplitPosition:], previousSplitPosition, signatureChunks)
+			chunks = append(chunks, newChunk(data[previousSplitPosition:], previousSplitPosition))
 		}
 	}
 
-	return signatureChunks
+	return chunks
 }
 
-func addNewChunkToSignature(chunkData []byte, offset int, fileSig signature) {
-	strongHash := sha256.Sum256(chunkData)
-	strongHashString := hex.EncodeToString(strongHash[:])
-	if _, ok := fileSig[strongHashString]; !ok {
-		fileSig[strongHashString] = Chunk{
-			Offset: offset,
-			Length: len(chunkData),
-			Data:   chunkData,
-			Hash:   hex.EncodeToString(strongHash[:]),
-		}
+func newChunk(chunkData []byte, offset int) Chunk {
+	return Chunk{
+		Offset: offset,
+		Length: len(chunkData),
+		Data:   chunkData,
+		Hash:   fingerprint(chunkData),
 	}
 }
 
+// fingerprint returns hex encoded SHA-256 of data, the same strong hash chunks use
+func fingerprint(data []byte) string {
+	strongHash := sha256.Sum256(data)
+	return hex.EncodeToString(strongHash[:])
+}
+
 func shouldSplit(rollingHash int, mask int) bool {
 	return (rollingHash & mask) == 0
 }
@@ -0,0 +1,167 @@
+package filediff
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+const (
+	// gitCopy marks copy opcode, lower bits tell which offset and size bytes follow
+	gitCopy = 0x80
+	// maxGitInsert is the longest insert of a single opcode
+	maxGitInsert = 0x7f
+	// maxGitCopy is the longest copy git itself produces, longer ones are split for compatibility with old readers
+	maxGitCopy = 0x10000
+	// maxGitOffset is the biggest offset which fits into four offset bytes
+	maxGitOffset = 0xffffffff
+)
+
+// EncodeGit writes delta in git's binary delta format (as used in pack files and binary patches):
+// sizes of the original and updated files followed by copy and insert opcodes
+func (d *Delta) EncodeGit(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	writeUvarint(bw, uint64(d.BaseSize))
+	writeUvarint(bw, uint64(d.TargetSize))
+
+	for _, op := range d.Ops {
+		switch op.Type {
+		case OpCopy:
+			if op.Offset < 0 || op.Length < 0 || op.Offset+op.Length > d.BaseSize {
+				return fmt.Errorf("%w: copy of %d bytes at %d is out of original file", ErrInvalidDelta, op.Length, op.Offset)
+			}
+			for offset, remaining := op.Offset, op.Length; remaining > 0; {
+				length := remaining
+				if length > maxGitCopy {
+					length = maxGitCopy
+				}
+				if offset > maxGitOffset {
+					return fmt.Errorf("%w: copy offset %d doesn't fit into git delta", ErrInvalidDelta, offset)
+				}
+				writeGitCopy(bw, offset, length)
+				offset += length
+				remaining -= length
+			}
+		case OpInsert:
+			for data := op.Data; len(data) > 0; {
+				length := len(data)
+				if length > maxGitInsert {
+					length = maxGitInsert
+				}
+				bw.WriteByte(byte(length))
+				bw.Write(data[:length])
+				data = data[length:]
+			}
+		default:
+			return fmt.Errorf("%w: unknown op type %d", ErrInvalidDelta, op.Type)
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("failed to write delta: %w", err)
+	}
+	return nil
+}
+
+// writeGitCopy writes copy opcode followed by non-zero bytes of offset and size, little endian.
+// Size 0x10000 is written without size bytes
+func writeGitCopy(w *bufio.Writer, offset, length int) {
+	if length == maxGitCopy {
+		length = 0
+	}
+	opcode := byte(gitCopy)
+	arguments := make([]byte, 0, 7)
+	for i := 0; i < 4; i++ {
+		if b := byte(offset >> (8 * i)); b != 0 {
+			opcode |= 1 << i
+			arguments = append(arguments, b)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if b := byte(length >> (8 * i)); b != 0 {
+			opcode |= 1 << (4 + i)
+			arguments = append(arguments, b)
+		}
+	}
+	w.WriteByte(opcode)
+	w.Write(arguments)
+}
+
+// DecodeGitDelta reads delta in git's binary delta format. Decoded delta has only Ops and sizes,
+// Reused and Changed chunks are empty
+func DecodeGitDelta(r io.Reader) (*Delta, error) {
+	br := bufio.NewReader(r)
+	delta := &Delta{Reused: make([]Chunk, 0), Changed: make([]Chunk, 0), Ops: make([]Op, 0)}
+	var err error
+	if delta.BaseSize, err = readUvarint(br); err != nil {
+		return nil, err
+	}
+	if delta.TargetSize, err = readUvarint(br); err != nil {
+		return nil, err
+	}
+
+	produced := 0
+	for {
+		opcode, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read delta: %w", err)
+		}
+
+		switch {
+		case opcode&gitCopy != 0:
+			offset, length := 0, 0
+			for i := 0; i < 7; i++ {
+				if opcode&(1<<i) == 0 {
+					continue
+				}
+				b, err := br.ReadByte()
+				if err != nil {
+					return nil, fmt.Errorf("failed to read delta: %w", err)
+				}
+				if i < 4 {
+					offset |= int(b) << (8 * i)
+				} else {
+					length |= int(b) << (8 * (i - 4))
+				}
+			}
+			if length == 0 {
+				length = maxGitCopy
+			}
+			if offset+length > delta.BaseSize || produced+length > delta.TargetSize {
+				return nil, fmt.Errorf("%w: copy of %d bytes at %d is out of bounds", ErrInvalidDelta, length, offset)
+			}
+			delta.Ops = appendCopy(delta.Ops, offset, length)
+			produced += length
+		case opcode != 0:
+			length := int(opcode)
+			if produced+length > delta.TargetSize {
+				return nil, fmt.Errorf("%w: insert of %d bytes exceeds target size", ErrInvalidDelta, length)
+			}
+			data := make([]byte, length)
+			if _, err = io.ReadFull(br, data); err != nil {
+				return nil, fmt.Errorf("failed to read delta: %w", err)
+			}
+			delta.Ops = appendInsert(delta.Ops, data)
+			produced += length
+		default:
+			return nil, fmt.Errorf("%w: reserved opcode 0", ErrInvalidDelta)
+		}
+	}
+
+	if produced != delta.TargetSize {
+		return nil, fmt.Errorf("%w: produced %d bytes, expected %d", ErrInvalidDelta, produced, delta.TargetSize)
+	}
+	return delta, nil
+}
+
+// PatchGit applies delta in git's binary delta format on the original file and writes the updated file to w
+func PatchGit(original io.ReaderAt, r io.Reader, w io.Writer) error {
+	delta, err := DecodeGitDelta(r)
+	if err != nil {
+		return err
+	}
+	return Patch(original, delta, w)
+}
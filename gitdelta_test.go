@@ -0,0 +1,128 @@
+package filediff
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGitDelta(t *testing.T) {
+	original := randomData(1, 256*1024)
+
+	testCases := map[string]struct {
+		updated []byte
+	}{
+		"should patch unchanged file": {
+			updated: original,
+		},
+		"should patch file modified in the middle": {
+			updated: append(append(append([]byte{}, original[:100*1024]...), randomData(2, 1000)...), original[101*1024:]...),
+		},
+		"should patch file with moved parts": {
+			updated: append(append([]byte{}, original[128*1024:]...), original[:128*1024]...),
+		},
+		"should patch completely different file": {
+			updated: randomData(3, 100*1024),
+		},
+		"should patch to empty file": {
+			updated: []byte{},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// given
+			delta, err := Diff(original, tc.updated, 4096)
+			require.NoError(t, err)
+			encoded := &bytes.Buffer{}
+			require.NoError(t, delta.EncodeGit(encoded))
+
+			// when
+			patched := &bytes.Buffer{}
+			err = PatchGit(bytes.NewReader(original), encoded, patched)
+
+			// then
+			require.NoError(t, err)
+			assert.Equal(t, string(tc.updated), patched.String())
+		})
+	}
+
+	t.Run("should encode opcodes as git does", func(t *testing.T) {
+		// given
+		delta := &Delta{
+			Ops: []Op{
+				{Type: OpCopy, Offset: 0x0102, Length: 5},
+				{Type: OpInsert, Length: 2, Data: []byte("ab")},
+				{Type: OpCopy, Offset: 0, Length: 0x10000},
+				{Type: OpCopy, Offset: 0x10000, Length: 0x10001},
+			},
+			BaseSize:   0x20001,
+			TargetSize: 0x20008,
+		}
+		encoded := &bytes.Buffer{}
+
+		// when
+		err := delta.EncodeGit(encoded)
+
+		// then
+		require.NoError(t, err)
+		assert.Equal(t, []byte{
+			0x81, 0x80, 0x08, // base size
+			0x88, 0x80, 0x08, // target size
+			0x93, 0x02, 0x01, 0x05, // copy with two offset bytes and one size byte
+			0x02, 'a', 'b', // insert
+			0x80,       // copy of 0x10000 bytes at 0
+			0x84, 0x01, // copy longer than 0x10000 bytes is split
+			0x94, 0x02, 0x01, // the rest of it
+		}, encoded.Bytes())
+	})
+
+	t.Run("should split long inserts", func(t *testing.T) {
+		// given
+		data := randomData(4, 300)
+		delta := &Delta{Ops: []Op{{Type: OpInsert, Length: len(data), Data: data}}, TargetSize: len(data)}
+		encoded := &bytes.Buffer{}
+
+		// when
+		require.NoError(t, delta.EncodeGit(encoded))
+		// sizes, three insert opcodes and data
+		encodedSize := encoded.Len()
+		decoded, err := DecodeGitDelta(encoded)
+
+		// then
+		require.NoError(t, err)
+		assert.Equal(t, 1+2+3+300, encodedSize)
+		assert.Equal(t, delta.Ops, decoded.Ops)
+	})
+}
+
+func TestDecodeGitDeltaErrors(t *testing.T) {
+	testCases := map[string]struct {
+		encoded []byte
+	}{
+		"should fail for reserved opcode": {
+			encoded: []byte{0x10, 0x01, 0x00},
+		},
+		"should fail for copy out of original file": {
+			encoded: []byte{0x10, 0x08, 0x91, 0x0c, 0x08},
+		},
+		"should fail for data longer than target size": {
+			encoded: []byte{0x10, 0x01, 0x02, 'a', 'b'},
+		},
+		"should fail for data shorter than target size": {
+			encoded: []byte{0x10, 0x04, 0x02, 'a', 'b'},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// when
+			_, err := DecodeGitDelta(bytes.NewReader(tc.encoded))
+
+			// then
+			assert.ErrorIs(t, err, ErrInvalidDelta)
+		})
+	}
+}
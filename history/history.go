@@ -0,0 +1,324 @@
+package history
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	filediff "file-diff"
+)
+
+const (
+	// DefaultKeyframeInterval is a default number of revisions between two keyframes
+	DefaultKeyframeInterval = 16
+	// keyframeExt is an extension of revisions stored in full
+	keyframeExt = ".key"
+	// deltaExt is an extension of revisions stored as a delta against previous revision
+	deltaExt = ".delta"
+	// fileDirExt is appended to escaped file name, so directory of a file is never . or ..
+	fileDirExt = ".revisions"
+	tempPrefix = ".tmp-"
+)
+
+// ErrNotFound is returned when file or its revision doesn't exist
+var ErrNotFound = errors.New("not found")
+
+// History keeps revisions of files. Revision N is stored as a delta against revision N-1 and every
+// keyframe interval revisions a full copy (keyframe) is stored, so any revision is reconstructed
+// from the nearest keyframe with a bounded number of patches.
+// Each file has its own directory (escaped name with .revisions extension) with revisions named after their numbers
+type History struct {
+	root             string
+	chunkSize        uint64
+	keyframeInterval int
+	mu               sync.Mutex
+}
+
+// Option configures History
+type Option func(*History)
+
+// WithKeyframeInterval sets number of revisions between two keyframes. Default is DefaultKeyframeInterval
+func WithKeyframeInterval(interval int) Option {
+	return func(h *History) {
+		h.keyframeInterval = interval
+	}
+}
+
+// Open opens history in root directory, creating it if it doesn't exist. Deltas are computed
+// with chunkSize which needs to be integer equal to power of two
+func Open(root string, chunkSize uint64, opts ...Option) (*History, error) {
+	h := &History{root: root, chunkSize: chunkSize, keyframeInterval: DefaultKeyframeInterval}
+	for _, opt := range opts {
+		opt(h)
+	}
+	if h.keyframeInterval < 1 {
+		return nil, errors.New("keyframe interval must be positive")
+	}
+	if _, err := filediff.Split(nil, chunkSize); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create history directory: %w", err)
+	}
+
+	return h, nil
+}
+
+// Commit stores data as the next revision of the file and returns its number. Revisions are numbered from 1
+func (h *History) Commit(name string, r io.Reader) (int, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read data of %s: %w", name, err)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	revisions, err := h.revisions(name)
+	if err != nil {
+		return 0, err
+	}
+	if len(revisions) == 0 {
+		if err = os.MkdirAll(h.fileDir(name), 0o755); err != nil {
+			return 0, fmt.Errorf("failed to create directory of %s: %w", name, err)
+		}
+		return 1, h.writeKeyframe(name, 1, data)
+	}
+
+	oldest, latest := revisions[0], revisions[len(revisions)-1]
+	revision := latest + 1
+	// keyframes are counted from the oldest revision, it's always a keyframe
+	if (revision-oldest)%h.keyframeInterval == 0 {
+		return revision, h.writeKeyframe(name, revision, data)
+	}
+	previous, err := h.reconstruct(name, latest)
+	if err != nil {
+		return 0, err
+	}
+	return revision, h.writeDelta(name, revision, previous, data)
+}
+
+// Get writes given revision of the file to w
+func (h *History) Get(name string, revision int, w io.Writer) error {
+	h.mu.Lock()
+	data, err := h.reconstruct(name, revision)
+	h.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if _, err = w.Write(data); err != nil {
+		return fmt.Errorf("failed to write revision %d of %s: %w", revision, name, err)
+	}
+	return nil
+}
+
+// Revisions returns numbers of stored revisions of the file, from the oldest one
+func (h *History) Revisions(name string) ([]int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	revisions, err := h.revisions(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(revisions) == 0 {
+		return nil, fmt.Errorf("file %s: %w", name, ErrNotFound)
+	}
+	return revisions, nil
+}
+
+// Compact removes revisions older than oldest and re-bases the remaining chain: oldest revision becomes
+// a keyframe and keyframes of the following revisions are placed again according to the current keyframe interval.
+// Revisions keep their numbers and every revision stays readable while compaction runs
+func (h *History) Compact(name string, oldest int) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	revisions, err := h.revisions(name)
+	if err != nil {
+		return err
+	}
+	if len(revisions) == 0 || oldest > revisions[len(revisions)-1] {
+		return fmt.Errorf("revision %d of %s: %w", oldest, name, ErrNotFound)
+	}
+	if oldest < revisions[0] {
+		oldest = revisions[0]
+	}
+
+	var previous []byte
+	for _, revision := range revisions {
+		if revision < oldest {
+			continue
+		}
+		// revisions are rewritten from the oldest one, so chain of the revision is already re-based
+		data, err := h.reconstruct(name, revision)
+		if err != nil {
+			return err
+		}
+		if (revision-oldest)%h.keyframeInterval == 0 {
+			err = h.writeKeyframe(name, revision, data)
+		} else {
+			err = h.writeDelta(name, revision, previous, data)
+		}
+		if err != nil {
+			return err
+		}
+		previous = data
+	}
+
+	// older revisions are removed from the newest, so remaining ones are still reconstructable on failure
+	for i := len(revisions) - 1; i >= 0; i-- {
+		if revisions[i] >= oldest {
+			continue
+		}
+		if err = h.remove(name, revisions[i], keyframeExt); err != nil {
+			return err
+		}
+		if err = h.remove(name, revisions[i], deltaExt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reconstruct returns content of the revision, starting from the nearest keyframe and applying following deltas
+func (h *History) reconstruct(name string, revision int) ([]byte, error) {
+	chain := make([]int, 0)
+	var data []byte
+	for current := revision; ; current-- {
+		keyframe, err := os.ReadFile(h.revisionPath(name, current, keyframeExt))
+		if err == nil {
+			data = keyframe
+			break
+		}
+		if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read revision %d of %s: %w", current, name, err)
+		}
+		if _, err = os.Stat(h.revisionPath(name, current, deltaExt)); err != nil {
+			if os.IsNotExist(err) {
+				return nil, fmt.Errorf("revision %d of %s: %w", current, name, ErrNotFound)
+			}
+			return nil, fmt.Errorf("failed to read revision %d of %s: %w", current, name, err)
+		}
+		chain = append(chain, current)
+	}
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		encoded, err := os.ReadFile(h.revisionPath(name, chain[i], deltaExt))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read revision %d of %s: %w", chain[i], name, err)
+		}
+		delta, err := filediff.DecodeDelta(bytes.NewReader(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode revision %d of %s: %w", chain[i], name, err)
+		}
+		patched := bytes.NewBuffer(make([]byte, 0, delta.TargetSize))
+		if err = filediff.Patch(bytes.NewReader(data), delta, patched); err != nil {
+			return nil, fmt.Errorf("failed to reconstruct revision %d of %s: %w", chain[i], name, err)
+		}
+		data = patched.Bytes()
+	}
+
+	return data, nil
+}
+
+// revisions returns numbers of stored revisions of the file, from the oldest one
+func (h *History) revisions(name string) ([]int, error) {
+	entries, err := os.ReadDir(h.fileDir(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []int{}, nil
+		}
+		return nil, fmt.Errorf("failed to list revisions of %s: %w", name, err)
+	}
+
+	seen := make(map[int]struct{}, len(entries))
+	revisions := make([]int, 0, len(entries))
+	for _, entry := range entries {
+		base := strings.TrimSuffix(strings.TrimSuffix(entry.Name(), keyframeExt), deltaExt)
+		revision, err := strconv.Atoi(base)
+		if err != nil || base == entry.Name() {
+			// temporary files or anything else which isn't a revision
+			continue
+		}
+		if _, ok := seen[revision]; !ok {
+			seen[revision] = struct{}{}
+			revisions = append(revisions, revision)
+		}
+	}
+	sort.Ints(revisions)
+
+	return revisions, nil
+}
+
+// writeKeyframe stores revision in full. Delta of the same revision is removed only once keyframe is stored
+func (h *History) writeKeyframe(name string, revision int, data []byte) error {
+	if err := writeFileAtomic(h.revisionPath(name, revision, keyframeExt), data); err != nil {
+		return fmt.Errorf("failed to write revision %d of %s: %w", revision, name, err)
+	}
+	return h.remove(name, revision, deltaExt)
+}
+
+// writeDelta stores revision as a delta against previous revision. Keyframe of the same revision is removed
+// only once delta is stored
+func (h *History) writeDelta(name string, revision int, previous, data []byte) error {
+	delta, err := filediff.Diff(previous, data, h.chunkSize)
+	if err != nil {
+		return err
+	}
+	encoded := &bytes.Buffer{}
+	if err = delta.Encode(encoded); err != nil {
+		return err
+	}
+	if err = writeFileAtomic(h.revisionPath(name, revision, deltaExt), encoded.Bytes()); err != nil {
+		return fmt.Errorf("failed to write revision %d of %s: %w", revision, name, err)
+	}
+	return h.remove(name, revision, keyframeExt)
+}
+
+func (h *History) remove(name string, revision int, ext string) error {
+	if err := os.Remove(h.revisionPath(name, revision, ext)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove revision %d of %s: %w", revision, name, err)
+	}
+	return nil
+}
+
+func (h *History) fileDir(name string) string {
+	return filepath.Join(h.root, url.PathEscape(name)+fileDirExt)
+}
+
+func (h *History) revisionPath(name string, revision int, ext string) string {
+	return filepath.Join(h.fileDir(name), fmt.Sprintf("%010d%s", revision, ext))
+}
+
+// writeFileAtomic writes data to a temporary file and renames it, so readers never see partial file
+func writeFileAtomic(path string, data []byte) (err error) {
+	file, err := os.CreateTemp(filepath.Dir(path), tempPrefix)
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(file.Name())
+		}
+	}()
+
+	if _, err = file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	if err = file.Close(); err != nil {
+		return fmt.Errorf("failed to close file: %w", err)
+	}
+	return os.Rename(file.Name(), path)
+}
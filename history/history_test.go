@@ -0,0 +1,209 @@
+package history
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistory(t *testing.T) {
+	testCases := map[string]struct {
+		revisions        int
+		keyframeInterval int
+		// keyframes expected revisions stored in full
+		keyframes []int
+	}{
+		"should store single revision as keyframe": {
+			revisions:        1,
+			keyframeInterval: 4,
+			keyframes:        []int{1},
+		},
+		"should store revisions as deltas between keyframes": {
+			revisions:        10,
+			keyframeInterval: 4,
+			keyframes:        []int{1, 5, 9},
+		},
+		"should store every revision as keyframe with interval of one": {
+			revisions:        3,
+			keyframeInterval: 1,
+			keyframes:        []int{1, 2, 3},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// given
+			h, err := Open(t.TempDir(), 4096, WithKeyframeInterval(tc.keyframeInterval))
+			require.NoError(t, err)
+			versions := testVersions(tc.revisions)
+
+			// when
+			for i, version := range versions {
+				revision, err := h.Commit("artifact.bin", bytes.NewReader(version))
+				require.NoError(t, err)
+				assert.Equal(t, i+1, revision)
+			}
+
+			// then
+			assert.Equal(t, tc.keyframes, keyframes(t, h, "artifact.bin"))
+			assertRevisions(t, h, "artifact.bin", versions, 1)
+		})
+	}
+
+	t.Run("should store deltas much smaller than revisions", func(t *testing.T) {
+		// given
+		root := t.TempDir()
+		h, err := Open(root, 4096)
+		require.NoError(t, err)
+
+		// when
+		for _, version := range testVersions(5) {
+			_, err = h.Commit("artifact.bin", bytes.NewReader(version))
+			require.NoError(t, err)
+		}
+
+		// then
+		stored := 0
+		entries, err := os.ReadDir(h.fileDir("artifact.bin"))
+		require.NoError(t, err)
+		for _, entry := range entries {
+			info, err := entry.Info()
+			require.NoError(t, err)
+			stored += int(info.Size())
+		}
+		assert.Less(t, stored, 256*1024+4*32*1024)
+	})
+
+	t.Run("should keep revisions of dot names inside history", func(t *testing.T) {
+		// given
+		parent := t.TempDir()
+		root := filepath.Join(parent, "history")
+		h, err := Open(root, 4096)
+		require.NoError(t, err)
+		names := []string{".", "..", "../artifact.bin"}
+
+		// when
+		for _, name := range names {
+			_, err = h.Commit(name, bytes.NewReader([]byte(name)))
+			require.NoError(t, err)
+		}
+
+		// then
+		entries, err := os.ReadDir(parent)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		assert.Equal(t, "history", entries[0].Name())
+		for _, name := range names {
+			assertRevisions(t, h, name, [][]byte{[]byte(name)}, 1)
+		}
+	})
+
+	t.Run("should not get unknown revision", func(t *testing.T) {
+		h, err := Open(t.TempDir(), 4096)
+		require.NoError(t, err)
+		_, err = h.Commit("artifact.bin", bytes.NewReader([]byte("content")))
+		require.NoError(t, err)
+
+		assert.ErrorIs(t, h.Get("artifact.bin", 2, &bytes.Buffer{}), ErrNotFound)
+		assert.ErrorIs(t, h.Get("other.bin", 1, &bytes.Buffer{}), ErrNotFound)
+	})
+
+	t.Run("should not open history with invalid keyframe interval", func(t *testing.T) {
+		_, err := Open(t.TempDir(), 4096, WithKeyframeInterval(0))
+		assert.ErrorContains(t, err, "keyframe interval must be positive")
+	})
+}
+
+func TestCompact(t *testing.T) {
+	testCases := map[string]struct {
+		oldest            int
+		compactedInterval int
+		keyframes         []int
+	}{
+		"should re-base chain on revision in the middle of it": {
+			oldest:            3,
+			compactedInterval: 4,
+			keyframes:         []int{3, 7},
+		},
+		"should re-base chain on keyframe": {
+			oldest:            5,
+			compactedInterval: 4,
+			keyframes:         []int{5, 9},
+		},
+		"should re-place keyframes with new interval": {
+			oldest:            1,
+			compactedInterval: 3,
+			keyframes:         []int{1, 4, 7, 10},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// given
+			root := t.TempDir()
+			h, err := Open(root, 4096, WithKeyframeInterval(4))
+			require.NoError(t, err)
+			versions := testVersions(10)
+			for _, version := range versions {
+				_, err = h.Commit("artifact.bin", bytes.NewReader(version))
+				require.NoError(t, err)
+			}
+			compacting, err := Open(root, 4096, WithKeyframeInterval(tc.compactedInterval))
+			require.NoError(t, err)
+
+			// when
+			err = compacting.Compact("artifact.bin", tc.oldest)
+
+			// then
+			require.NoError(t, err)
+			assert.Equal(t, tc.keyframes, keyframes(t, compacting, "artifact.bin"))
+			revisions, err := compacting.Revisions("artifact.bin")
+			require.NoError(t, err)
+			assert.Equal(t, tc.oldest, revisions[0])
+			assertRevisions(t, compacting, "artifact.bin", versions[tc.oldest-1:], tc.oldest)
+			assert.ErrorIs(t, compacting.Get("artifact.bin", tc.oldest-1, &bytes.Buffer{}), ErrNotFound)
+		})
+	}
+}
+
+// testVersions returns consecutive versions of a file, each one modified in a single place
+func testVersions(count int) [][]byte {
+	random := rand.New(rand.NewSource(1))
+	current := make([]byte, 256*1024)
+	random.Read(current)
+
+	versions := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		version := append([]byte{}, current...)
+		offset := random.Intn(len(version) - 100)
+		random.Read(version[offset : offset+100])
+		versions = append(versions, version)
+		current = version
+	}
+	return versions
+}
+
+func keyframes(t *testing.T, h *History, name string) []int {
+	revisions, err := h.Revisions(name)
+	require.NoError(t, err)
+	result := make([]int, 0)
+	for _, revision := range revisions {
+		if _, err := os.Stat(h.revisionPath(name, revision, keyframeExt)); err == nil {
+			result = append(result, revision)
+		}
+	}
+	return result
+}
+
+func assertRevisions(t *testing.T, h *History, name string, versions [][]byte, first int) {
+	for i, version := range versions {
+		buffer := &bytes.Buffer{}
+		require.NoError(t, h.Get(name, first+i, buffer))
+		assert.Equal(t, version, buffer.Bytes(), "revision %d", first+i)
+	}
+}
@@ -0,0 +1,111 @@
+package bzip2
+
+// crcTable is a table of CRC-32 with polynomial 0x04c11db7, most significant bit first, as used by bzip2
+var crcTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		c := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if c&0x80000000 != 0 {
+				c = c<<1 ^ 0x04c11db7
+			} else {
+				c <<= 1
+			}
+		}
+		table[i] = c
+	}
+	return table
+}()
+
+func crc(data []byte) uint32 {
+	c := ^uint32(0)
+	for _, b := range data {
+		c = c<<8 ^ crcTable[byte(c>>24)^b]
+	}
+	return ^c
+}
+
+// bwt returns the last column of sorted rotations of data (Burrows-Wheeler transform) and the position
+// of data itself among sorted rotations. Rotations are sorted by prefix doubling: in every round they are
+// ordered by rank pairs of their two halves with counting sort
+func bwt(data []byte) ([]byte, int) {
+	n := len(data)
+	if n == 0 {
+		return []byte{}, 0
+	}
+
+	sorted := make([]int32, n)
+	rank := make([]int32, n)
+	buffer := make([]int32, n)
+	counts := make([]int32, max(n, 256)+1)
+
+	// first round sorts rotations by their first byte
+	for _, b := range data {
+		counts[int(b)+1]++
+	}
+	for i := 1; i <= 256; i++ {
+		counts[i] += counts[i-1]
+	}
+	for i, b := range data {
+		sorted[counts[b]] = int32(i)
+		counts[b]++
+	}
+	classes := int32(1)
+	rank[sorted[0]] = 0
+	for i := 1; i < n; i++ {
+		if data[sorted[i]] != data[sorted[i-1]] {
+			classes++
+		}
+		rank[sorted[i]] = classes - 1
+	}
+
+	for length := 1; length < n && int(classes) < n; length *= 2 {
+		// rotations ordered by their second half, which is already sorted
+		for i, start := range sorted {
+			buffer[i] = int32((int(start) - length + n) % n)
+		}
+		// stable counting sort by the first half
+		for i := range counts[:classes+1] {
+			counts[i] = 0
+		}
+		for _, start := range buffer {
+			counts[rank[start]+1]++
+		}
+		for i := int32(1); i <= classes; i++ {
+			counts[i] += counts[i-1]
+		}
+		for _, start := range buffer {
+			sorted[counts[rank[start]]] = start
+			counts[rank[start]]++
+		}
+
+		buffer[sorted[0]] = 0
+		classes = 1
+		for i := 1; i < n; i++ {
+			current, previous := sorted[i], sorted[i-1]
+			if rank[current] != rank[previous] || rank[(int(current)+length)%n] != rank[(int(previous)+length)%n] {
+				classes++
+			}
+			buffer[current] = classes - 1
+		}
+		rank, buffer = buffer, rank
+	}
+
+	last := make([]byte, n)
+	origin := 0
+	for i, start := range sorted {
+		if start == 0 {
+			origin = i
+		}
+		last[i] = data[(int(start)+n-1)%n]
+	}
+
+	return last, origin
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
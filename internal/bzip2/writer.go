@@ -0,0 +1,378 @@
+// Package bzip2 implements bzip2 compression. Standard library provides only decompression (compress/bzip2),
+// but formats like BSDIFF40 need both
+package bzip2
+
+import (
+	"errors"
+	"io"
+)
+
+const (
+	// level is a block size in 100 KB units, the biggest one is used
+	level = 9
+	// maxBlockSize is the biggest block after the initial run length encoding, the same as in bzip2
+	maxBlockSize = level*100000 - 19
+	// maxRawBlockSize is how much input is put into a single block. Run length encoding expands data by 1/4 at most
+	maxRawBlockSize = maxBlockSize * 4 / 5
+	// groupSize is number of symbols coded with the same Huffman table
+	groupSize = 50
+	// maxCodeLength is the longest Huffman code, the same as in bzip2
+	maxCodeLength = 17
+	// tables is number of Huffman tables, format requires at least two
+	tables = 2
+)
+
+const (
+	blockMagic       = 0x314159265359
+	endOfStreamMagic = 0x177245385090
+	runA             = 0
+	runB             = 1
+)
+
+// Writer compresses data written to it in bzip2 format
+type Writer struct {
+	w           *bitWriter
+	block       []byte
+	combinedCRC uint32
+	wroteHeader bool
+	closed      bool
+}
+
+// NewWriter returns Writer which writes compressed data to w. Close must be called to finish the stream
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: &bitWriter{w: w}, block: make([]byte, 0, maxRawBlockSize)}
+}
+
+// Write compresses data, it's written to the underlying writer when block is complete
+func (z *Writer) Write(data []byte) (int, error) {
+	if z.closed {
+		return 0, errors.New("bzip2: write to closed writer")
+	}
+
+	written := 0
+	for len(data) > 0 {
+		n := maxRawBlockSize - len(z.block)
+		if n > len(data) {
+			n = len(data)
+		}
+		z.block = append(z.block, data[:n]...)
+		data = data[n:]
+		written += n
+		if len(z.block) == maxRawBlockSize {
+			if err := z.writeBlock(); err != nil {
+				return written, err
+			}
+		}
+	}
+
+	return written, nil
+}
+
+// Close writes remaining data and the end of the stream. It doesn't close the underlying writer
+func (z *Writer) Close() error {
+	if z.closed {
+		return nil
+	}
+	z.closed = true
+
+	if len(z.block) > 0 {
+		if err := z.writeBlock(); err != nil {
+			return err
+		}
+	}
+	z.writeHeader()
+	z.w.writeBits(48, endOfStreamMagic)
+	z.w.writeBits(32, uint64(z.combinedCRC))
+	return z.w.flush()
+}
+
+func (z *Writer) writeHeader() {
+	if !z.wroteHeader {
+		z.w.writeBytes([]byte{'B', 'Z', 'h', '0' + level})
+		z.wroteHeader = true
+	}
+}
+
+// writeBlock compresses buffered data as a single block: run length encoding, Burrows-Wheeler transform,
+// move to front transform with zero runs encoding and finally Huffman coding
+func (z *Writer) writeBlock() error {
+	z.writeHeader()
+	blockCRC := crc(z.block)
+	z.combinedCRC = (z.combinedCRC<<1 | z.combinedCRC>>31) ^ blockCRC
+
+	rle := runLengthEncode(z.block)
+	z.block = z.block[:0]
+	last, origPtr := bwt(rle)
+
+	var inUse [256]bool
+	for _, b := range rle {
+		inUse[b] = true
+	}
+	symbols, alphaSize := moveToFront(last, inUse)
+
+	z.w.writeBits(48, blockMagic)
+	z.w.writeBits(32, uint64(blockCRC))
+	// block is never randomised
+	z.w.writeBits(1, 0)
+	z.w.writeBits(24, uint64(origPtr))
+
+	// used bytes, in 16 ranges of 16 bytes
+	var ranges uint64
+	for i := 0; i < 16; i++ {
+		for j := 0; j < 16; j++ {
+			if inUse[i*16+j] {
+				ranges |= 1 << (15 - i)
+				break
+			}
+		}
+	}
+	z.w.writeBits(16, ranges)
+	for i := 0; i < 16; i++ {
+		if ranges&(1<<(15-i)) == 0 {
+			continue
+		}
+		var used uint64
+		for j := 0; j < 16; j++ {
+			if inUse[i*16+j] {
+				used |= 1 << (15 - j)
+			}
+		}
+		z.w.writeBits(16, used)
+	}
+
+	frequencies := make([]int, alphaSize)
+	for _, symbol := range symbols {
+		frequencies[symbol]++
+	}
+	lengths := codeLengths(frequencies, maxCodeLength)
+	codes := canonicalCodes(lengths)
+
+	// all tables are the same and every group uses the first one
+	selectors := (len(symbols) + groupSize - 1) / groupSize
+	z.w.writeBits(3, tables)
+	z.w.writeBits(15, uint64(selectors))
+	for i := 0; i < selectors; i++ {
+		// move to front coded selector 0
+		z.w.writeBits(1, 0)
+	}
+	for t := 0; t < tables; t++ {
+		current := int(lengths[0])
+		z.w.writeBits(5, uint64(current))
+		for _, length := range lengths {
+			for current < int(length) {
+				z.w.writeBits(2, 2)
+				current++
+			}
+			for current > int(length) {
+				z.w.writeBits(2, 3)
+				current--
+			}
+			z.w.writeBits(1, 0)
+		}
+	}
+
+	for _, symbol := range symbols {
+		z.w.writeBits(uint(lengths[symbol]), uint64(codes[symbol]))
+	}
+
+	return z.w.err
+}
+
+// runLengthEncode replaces runs of 4 to 255 equal bytes with 4 bytes and number of remaining repeats
+func runLengthEncode(data []byte) []byte {
+	encoded := make([]byte, 0, len(data)+len(data)/4)
+	for i := 0; i < len(data); {
+		run := 1
+		for i+run < len(data) && run < 255 && data[i+run] == data[i] {
+			run++
+		}
+		if run < 4 {
+			encoded = append(encoded, data[i:i+run]...)
+		} else {
+			encoded = append(encoded, data[i], data[i], data[i], data[i], byte(run-4))
+		}
+		i += run
+	}
+	return encoded
+}
+
+// moveToFront applies move to front transform on used bytes and encodes runs of zeros with RUNA and RUNB symbols.
+// Other values are shifted by one and the block is ended with end of block symbol. It returns symbols and size
+// of their alphabet
+func moveToFront(data []byte, inUse [256]bool) ([]uint16, int) {
+	order := make([]byte, 0, 256)
+	for b, used := range inUse {
+		if used {
+			order = append(order, byte(b))
+		}
+	}
+	endOfBlock := uint16(len(order) + 1)
+
+	symbols := make([]uint16, 0, len(data)+1)
+	zeros := 0
+	flushZeros := func() {
+		// bijective base 2, RUNA is digit 1 and RUNB digit 2, least significant first
+		for zeros > 0 {
+			if zeros&1 == 1 {
+				symbols = append(symbols, runA)
+				zeros = (zeros - 1) / 2
+			} else {
+				symbols = append(symbols, runB)
+				zeros = (zeros - 2) / 2
+			}
+		}
+	}
+
+	for _, b := range data {
+		position := 0
+		for order[position] != b {
+			position++
+		}
+		if position == 0 {
+			zeros++
+			continue
+		}
+		flushZeros()
+		copy(order[1:position+1], order[:position])
+		order[0] = b
+		symbols = append(symbols, uint16(position+1))
+	}
+	flushZeros()
+	symbols = append(symbols, endOfBlock)
+
+	return symbols, int(endOfBlock) + 1
+}
+
+// codeLengths returns lengths of Huffman codes for symbols with given frequencies, none of them longer than maxLength.
+// Every symbol gets a code, even if it's not used
+func codeLengths(frequencies []int, maxLength int) []uint8 {
+	weights := make([]int, len(frequencies))
+	for i, frequency := range frequencies {
+		weights[i] = frequency
+		if weights[i] == 0 {
+			weights[i] = 1
+		}
+	}
+
+	for {
+		lengths, longest := huffmanLengths(weights)
+		if longest <= maxLength {
+			return lengths
+		}
+		// flatter weights give shorter longest code
+		for i := range weights {
+			weights[i] = weights[i]/2 + 1
+		}
+	}
+}
+
+// huffmanLengths builds Huffman tree and returns depth of every symbol and the biggest one
+func huffmanLengths(weights []int) ([]uint8, int) {
+	// nodes are symbols followed by internal nodes, alphabet is small so the two lightest nodes are searched linearly
+	nodeWeights := append(make([]int, 0, 2*len(weights)), weights...)
+	parents := make([]int, len(weights), 2*len(weights))
+	active := make([]bool, len(weights), 2*len(weights))
+	for i := range active {
+		active[i] = true
+	}
+
+	for remaining := len(weights); remaining > 1; remaining-- {
+		first, second := -1, -1
+		for i, weight := range nodeWeights {
+			if !active[i] {
+				continue
+			}
+			if first < 0 || weight < nodeWeights[first] {
+				first, second = i, first
+			} else if second < 0 || weight < nodeWeights[second] {
+				second = i
+			}
+		}
+		active[first], active[second] = false, false
+		parents[first], parents[second] = len(nodeWeights), len(nodeWeights)
+		nodeWeights = append(nodeWeights, nodeWeights[first]+nodeWeights[second])
+		parents = append(parents, -1)
+		active = append(active, true)
+	}
+
+	lengths := make([]uint8, len(weights))
+	longest := 0
+	for i := range weights {
+		depth := 0
+		for node := i; parents[node] >= 0 && node != len(nodeWeights)-1; node = parents[node] {
+			depth++
+		}
+		lengths[i] = uint8(depth)
+		if depth > longest {
+			longest = depth
+		}
+	}
+
+	return lengths, longest
+}
+
+// canonicalCodes assigns codes the same way as bzip2: shorter codes first, codes of the same length by symbol order
+func canonicalCodes(lengths []uint8) []uint32 {
+	codes := make([]uint32, len(lengths))
+	code := uint32(0)
+	for length := uint8(1); length <= maxCodeLength; length++ {
+		for symbol, symbolLength := range lengths {
+			if symbolLength == length {
+				codes[symbol] = code
+				code++
+			}
+		}
+		code <<= 1
+	}
+	return codes
+}
+
+// bitWriter writes bits most significant first
+type bitWriter struct {
+	w     io.Writer
+	bits  uint64
+	count uint
+	out   []byte
+	err   error
+}
+
+func (b *bitWriter) writeBits(count uint, value uint64) {
+	for count > 0 {
+		n := count
+		if n > 32 {
+			n = 32
+		}
+		count -= n
+		b.bits = b.bits<<n | (value>>count)&(1<<n-1)
+		b.count += n
+		for b.count >= 8 {
+			b.count -= 8
+			b.out = append(b.out, byte(b.bits>>b.count))
+		}
+	}
+	if len(b.out) >= 64*1024 {
+		b.write()
+	}
+}
+
+func (b *bitWriter) writeBytes(data []byte) {
+	for _, d := range data {
+		b.writeBits(8, uint64(d))
+	}
+}
+
+func (b *bitWriter) write() {
+	if b.err == nil {
+		_, b.err = b.w.Write(b.out)
+	}
+	b.out = b.out[:0]
+}
+
+// flush writes remaining bits padded with zeros to a full byte
+func (b *bitWriter) flush() error {
+	if b.count > 0 {
+		b.writeBits(8-b.count, 0)
+	}
+	b.write()
+	return b.err
+}
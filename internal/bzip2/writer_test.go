@@ -0,0 +1,90 @@
+package bzip2
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriter(t *testing.T) {
+	testCases := map[string]struct {
+		data []byte
+	}{
+		"should compress empty data": {
+			data: []byte{},
+		},
+		"should compress single byte": {
+			data: []byte("a"),
+		},
+		"should compress text": {
+			data: bytes.Repeat([]byte("Hello everyone, this will be a very short text about nothing. "), 100),
+		},
+		"should compress random data": {
+			data: randomData(1, 100*1024),
+		},
+		"should compress long runs of the same byte": {
+			data: append(append(bytes.Repeat([]byte{0}, 1000), 1, 2, 3, 3, 3, 3), bytes.Repeat([]byte{7}, 300)...),
+		},
+		"should compress periodic data": {
+			data: bytes.Repeat([]byte("ab"), 5000),
+		},
+		"should compress data of many blocks": {
+			data: append(randomData(2, maxRawBlockSize), bytes.Repeat([]byte("xyz"), 100000)...),
+		},
+		"should compress data using all byte values": {
+			data: func() []byte {
+				data := make([]byte, 0, 256*10)
+				for i := 0; i < 10; i++ {
+					for b := 0; b < 256; b++ {
+						data = append(data, byte(b))
+					}
+				}
+				return data
+			}(),
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// given
+			compressed := &bytes.Buffer{}
+			w := NewWriter(compressed)
+
+			// when
+			_, err := w.Write(tc.data)
+			require.NoError(t, err)
+			require.NoError(t, w.Close())
+
+			// then
+			decompressed, err := io.ReadAll(bzip2.NewReader(compressed))
+			require.NoError(t, err)
+			assert.Equal(t, string(tc.data), string(decompressed))
+		})
+	}
+
+	t.Run("should compress repetitive data well", func(t *testing.T) {
+		// given
+		data := bytes.Repeat([]byte("Hello everyone, this will be a very short text about nothing. "), 1000)
+		compressed := &bytes.Buffer{}
+		w := NewWriter(compressed)
+
+		// when
+		_, err := w.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+
+		// then
+		assert.Less(t, compressed.Len(), len(data)/50)
+	})
+}
+
+func randomData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
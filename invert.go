@@ -0,0 +1,89 @@
+package filediff
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Invert returns delta from the updated file back to the original one (rollback patch) for delta produced
+// from the original file. Original bytes which are copied by delta are copied back from the updated file,
+// so literal data contains only original bytes which delta overwrote or removed.
+// Inverted delta has only Ops, Reused and Changed chunks are empty
+func Invert(original io.ReaderAt, delta *Delta) (*Delta, error) {
+	// copied are parts of the original file present in the updated one, ordered by their original offset
+	type copied struct {
+		offset       int
+		targetOffset int
+		length       int
+	}
+	copies := make([]copied, 0, len(delta.Ops))
+	targetOffset := 0
+	for _, op := range delta.Ops {
+		switch op.Type {
+		case OpCopy:
+			if copyOutOfBounds(op, delta.BaseSize) {
+				return nil, fmt.Errorf("%w: copy of %d bytes at %d is out of original file", ErrInvalidDelta, op.Length, op.Offset)
+			}
+		case OpInsert:
+			if len(op.Data) != op.Length {
+				return nil, fmt.Errorf("%w: insert of %d bytes has %d bytes of data", ErrInvalidDelta, op.Length, len(op.Data))
+			}
+		default:
+			return nil, fmt.Errorf("%w: unknown op type %d", ErrInvalidDelta, op.Type)
+		}
+		// lengths are checked against what is left, so ends of copies below can't overflow either
+		if op.Length > delta.TargetSize-targetOffset {
+			return nil, fmt.Errorf("%w: produced more than %d bytes", ErrInvalidDelta, delta.TargetSize)
+		}
+		if op.Type == OpCopy && op.Length > 0 {
+			copies = append(copies, copied{offset: op.Offset, targetOffset: targetOffset, length: op.Length})
+		}
+		targetOffset += op.Length
+	}
+	if targetOffset != delta.TargetSize {
+		return nil, fmt.Errorf("%w: produced %d bytes, expected %d", ErrInvalidDelta, targetOffset, delta.TargetSize)
+	}
+	sort.Slice(copies, func(i, j int) bool {
+		return copies[i].offset < copies[j].offset
+	})
+
+	ops := make([]Op, 0, len(copies))
+	// best is a copy which covers current position and reaches the furthest
+	next, best, bestEnd := 0, -1, 0
+	for position := 0; position < delta.BaseSize; {
+		for ; next < len(copies) && copies[next].offset <= position; next++ {
+			if end := copies[next].offset + copies[next].length; end > bestEnd {
+				best, bestEnd = next, end
+			}
+		}
+
+		if best >= 0 && bestEnd > position {
+			ops = appendCopy(ops, copies[best].targetOffset+position-copies[best].offset, bestEnd-position)
+			position = bestEnd
+			continue
+		}
+
+		// original bytes up to the next copied part were removed or overwritten
+		end := delta.BaseSize
+		if next < len(copies) {
+			end = copies[next].offset
+		}
+		data := make([]byte, end-position)
+		if _, err := original.ReadAt(data, int64(position)); err != nil {
+			return nil, fmt.Errorf("failed to read original data: %w", err)
+		}
+		ops = appendInsert(ops, data)
+		position = end
+	}
+
+	return &Delta{
+		Reused:     make([]Chunk, 0),
+		Changed:    make([]Chunk, 0),
+		Ops:        ops,
+		BaseSize:   delta.TargetSize,
+		TargetSize: delta.BaseSize,
+		BaseHash:   delta.TargetHash,
+		TargetHash: delta.BaseHash,
+	}, nil
+}
@@ -0,0 +1,92 @@
+package filediff
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInvert(t *testing.T) {
+	original := randomData(1, 256*1024)
+
+	testCases := map[string]struct {
+		updated []byte
+		// maxLiteral is upper bound of literal data in inverted delta
+		maxLiteral int
+	}{
+		"should invert delta of unchanged file": {
+			updated:    original,
+			maxLiteral: 0,
+		},
+		"should invert delta of file with removed part": {
+			updated:    append(append([]byte{}, original[:100*1024]...), original[164*1024:]...),
+			maxLiteral: 64*1024 + 16*1024,
+		},
+		"should invert delta of file with added part": {
+			updated:    append(append(append([]byte{}, original[:100*1024]...), randomData(2, 10*1024)...), original[100*1024:]...),
+			maxLiteral: 16 * 1024,
+		},
+		"should invert delta of file with moved and repeated parts": {
+			updated:    append(append(append([]byte{}, original[128*1024:]...), original[:128*1024]...), original[:64*1024]...),
+			maxLiteral: 16 * 1024,
+		},
+		"should invert delta of completely different file": {
+			updated:    randomData(3, 10*1024),
+			maxLiteral: len(original),
+		},
+		"should invert delta of emptied file": {
+			updated:    []byte{},
+			maxLiteral: len(original),
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// given
+			delta, err := Diff(original, tc.updated, 4096)
+			require.NoError(t, err)
+
+			// when
+			inverted, err := Invert(bytes.NewReader(original), delta)
+
+			// then
+			require.NoError(t, err)
+			rolledBack := &bytes.Buffer{}
+			require.NoError(t, Patch(bytes.NewReader(tc.updated), inverted, rolledBack))
+			assert.Equal(t, string(original), rolledBack.String())
+			literal := 0
+			for _, op := range inverted.Ops {
+				if op.Type == OpInsert {
+					literal += op.Length
+				}
+			}
+			assert.LessOrEqual(t, literal, tc.maxLiteral)
+		})
+	}
+
+	t.Run("should reject copy out of original file", func(t *testing.T) {
+		// given
+		delta := &Delta{BaseSize: len(original), TargetSize: 1, Ops: []Op{{Type: OpCopy, Offset: math.MaxInt, Length: 1}}}
+
+		// when
+		_, err := Invert(bytes.NewReader(original), delta)
+
+		// then
+		assert.ErrorIs(t, err, ErrInvalidDelta)
+	})
+
+	t.Run("should not invert delta with original file too short", func(t *testing.T) {
+		// given
+		delta, err := Diff(original, randomData(3, 1024), 4096)
+		require.NoError(t, err)
+
+		// when
+		_, err = Invert(bytes.NewReader(original[:1024]), delta)
+
+		// then
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,87 @@
+package filediff
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Metadata of a tree entry which is not part of its content
+type Metadata struct {
+	// Mode holds entry type and permission bits
+	Mode os.FileMode
+	// ModTime last modification time. Zero for symbolic links
+	ModTime time.Time
+	// UID owner user id. Set only on Linux
+	UID int
+	// GID owner group id. Set only on Linux
+	GID int
+	// Symlink target of symbolic link. Empty for other entries
+	Symlink string
+	// Xattrs extended attributes. Set only on Linux and not for symbolic links
+	Xattrs map[string][]byte
+}
+
+// Equal reports whether both metadata are the same
+func (m Metadata) Equal(other Metadata) bool {
+	if m.Mode != other.Mode || !m.ModTime.Equal(other.ModTime) || m.UID != other.UID ||
+		m.GID != other.GID || m.Symlink != other.Symlink || len(m.Xattrs) != len(other.Xattrs) {
+		return false
+	}
+	for name, value := range m.Xattrs {
+		otherValue, ok := other.Xattrs[name]
+		if !ok || !bytes.Equal(value, otherValue) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ReadMetadata reads metadata of the entry under path. Symbolic links are not followed
+func ReadMetadata(path string) (Metadata, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return Metadata{}, fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+
+	metadata := Metadata{
+		Mode:    info.Mode(),
+		ModTime: info.ModTime(),
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		if metadata.Symlink, err = os.Readlink(path); err != nil {
+			return Metadata{}, fmt.Errorf("failed to read symlink %s: %w", path, err)
+		}
+		// it can't be restored without following the link, so it's not tracked
+		metadata.ModTime = time.Time{}
+	}
+	if err = readPlatformMetadata(path, info, &metadata); err != nil {
+		return Metadata{}, err
+	}
+
+	return metadata, nil
+}
+
+// RestoreMetadata applies metadata to the existing entry under path. Ownership is restored
+// before mode, so setuid and setgid bits are not cleared by it. Ownership and extended attributes which
+// the user or filesystem isn't permitted to set are skipped, mode and modification time are always restored
+func RestoreMetadata(path string, metadata Metadata) error {
+	if err := restorePlatformMetadata(path, metadata); err != nil {
+		return err
+	}
+	// symbolic link mode and times can't be changed without following it
+	if metadata.Mode&os.ModeSymlink != 0 {
+		return nil
+	}
+
+	if err := os.Chmod(path, metadata.Mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return fmt.Errorf("failed to change mode of %s: %w", path, err)
+	}
+	if err := os.Chtimes(path, metadata.ModTime, metadata.ModTime); err != nil {
+		return fmt.Errorf("failed to change times of %s: %w", path, err)
+	}
+
+	return nil
+}
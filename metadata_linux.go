@@ -0,0 +1,116 @@
+//go:build linux
+
+package filediff
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+func readPlatformMetadata(path string, info os.FileInfo, metadata *Metadata) error {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		metadata.UID = int(stat.Uid)
+		metadata.GID = int(stat.Gid)
+	}
+	// syscall package has no l* variants of xattr functions, so they would follow the link
+	if info.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+
+	xattrs, err := readXattrs(path)
+	if err != nil {
+		return fmt.Errorf("failed to read extended attributes of %s: %w", path, err)
+	}
+	metadata.Xattrs = xattrs
+
+	return nil
+}
+
+func restorePlatformMetadata(path string, metadata Metadata) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	// only privileged user can change ownership, so don't try if it's already right
+	if stat, ok := info.Sys().(*syscall.Stat_t); !ok || int(stat.Uid) != metadata.UID || int(stat.Gid) != metadata.GID {
+		if err = os.Lchown(path, metadata.UID, metadata.GID); err != nil && !notPermitted(err) {
+			return fmt.Errorf("failed to change owner of %s: %w", path, err)
+		}
+	}
+	if metadata.Mode&os.ModeSymlink != 0 {
+		return nil
+	}
+
+	for name, value := range metadata.Xattrs {
+		if err = syscall.Setxattr(path, name, value, 0); err != nil && !notPermitted(err) {
+			return fmt.Errorf("failed to set extended attribute %s of %s: %w", name, path, err)
+		}
+	}
+
+	return nil
+}
+
+// notPermitted reports whether ownership or extended attribute can't be restored by the current user
+// (e.g. files of other users, security.* and trusted.* attributes) or by the filesystem. Such metadata is
+// restored only on best effort basis
+func notPermitted(err error) bool {
+	return errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.ENOTSUP)
+}
+
+func readXattrs(path string) (map[string][]byte, error) {
+	names, err := readXattr(path, func(dest []byte) (int, error) {
+		return syscall.Listxattr(path, dest)
+	})
+	if err != nil {
+		if errors.Is(err, syscall.ENOTSUP) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var xattrs map[string][]byte
+	for _, name := range bytes.Split(names, []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		value, err := readXattr(path, func(dest []byte) (int, error) {
+			return syscall.Getxattr(path, string(name), dest)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if xattrs == nil {
+			xattrs = make(map[string][]byte)
+		}
+		xattrs[string(name)] = value
+	}
+
+	return xattrs, nil
+}
+
+// readXattr calls read with buffer big enough to fit the attribute data. Size is asked first
+// and call is retried if attribute grew in the meantime
+func readXattr(path string, read func(dest []byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := read(nil)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return []byte{}, nil
+		}
+
+		dest := make([]byte, size)
+		size, err = read(dest)
+		if errors.Is(err, syscall.ERANGE) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return dest[:size], nil
+	}
+}
@@ -0,0 +1,84 @@
+//go:build linux
+
+package filediff
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTreeDiffXattrs(t *testing.T) {
+	// given
+	content := randomData(1, 8*1024)
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	original := writeMetadataTestTree(t, content, modTime)
+	updated := writeMetadataTestTree(t, content, modTime)
+	toolPath := filepath.Join(updated, "bin", "tool")
+	if err := syscall.Setxattr(toolPath, "user.checksum", []byte("abc"), 0); err != nil {
+		t.Skipf("extended attributes not supported: %v", err)
+	}
+	require.NoError(t, os.Chtimes(toolPath, modTime, modTime))
+	target := filepath.Join(t.TempDir(), "target")
+
+	// when
+	delta, err := TreeDiff(original, updated, uint64(1024))
+	require.NoError(t, err)
+	err = ApplyTree(original, target, delta)
+
+	// then
+	require.NoError(t, err)
+	for _, file := range delta.Files {
+		if file.Path == "bin/tool" {
+			assert.True(t, file.Unchanged)
+			assert.True(t, file.MetadataChanged)
+			assert.Equal(t, map[string][]byte{"user.checksum": []byte("abc")}, file.Metadata.Xattrs)
+		}
+	}
+	assertSameTrees(t, updated, target)
+}
+
+func TestRestoreMetadataBestEffort(t *testing.T) {
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	testCases := map[string]struct {
+		metadata Metadata
+		skip     bool
+	}{
+		"should skip extended attributes not supported by filesystem": {
+			metadata: Metadata{Mode: 0o600, ModTime: modTime, UID: os.Getuid(), GID: os.Getgid(),
+				Xattrs: map[string][]byte{"unsupported.name": []byte("value")}},
+		},
+		"should skip ownership which user can't change": {
+			metadata: Metadata{Mode: 0o600, ModTime: modTime, UID: 0, GID: 0},
+			// root can change ownership of anything
+			skip: os.Getuid() == 0,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if tc.skip {
+				t.Skip("user is permitted to restore metadata")
+			}
+			// given
+			path := filepath.Join(t.TempDir(), "file")
+			require.NoError(t, os.WriteFile(path, []byte("data"), 0o644))
+
+			// when
+			err := RestoreMetadata(path, tc.metadata)
+
+			// then
+			require.NoError(t, err)
+			info, err := os.Stat(path)
+			require.NoError(t, err)
+			assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+			assert.True(t, modTime.Equal(info.ModTime()))
+		})
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package filediff
+
+import "os"
+
+// ownership and extended attributes are supported only on Linux
+func readPlatformMetadata(path string, info os.FileInfo, metadata *Metadata) error {
+	return nil
+}
+
+func restorePlatformMetadata(path string, metadata Metadata) error {
+	return nil
+}
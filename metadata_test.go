@@ -0,0 +1,116 @@
+package filediff
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTreeDiffMetadata(t *testing.T) {
+	content := randomData(1, 8*1024)
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	testCases := map[string]struct {
+		// modify is called on updated tree which is a copy of original one
+		modify          func(t *testing.T, root string)
+		path            string
+		unchanged       bool
+		metadataChanged bool
+	}{
+		"should not report change of untouched file": {
+			modify:          func(t *testing.T, root string) {},
+			path:            "bin/tool",
+			unchanged:       true,
+			metadataChanged: false,
+		},
+		"should express mode change without content": {
+			modify: func(t *testing.T, root string) {
+				require.NoError(t, os.Chmod(filepath.Join(root, "bin/tool"), 0o700))
+			},
+			path:            "bin/tool",
+			unchanged:       true,
+			metadataChanged: true,
+		},
+		"should express modification time change without content": {
+			modify: func(t *testing.T, root string) {
+				changed := modTime.Add(time.Hour)
+				require.NoError(t, os.Chtimes(filepath.Join(root, "bin/tool"), changed, changed))
+			},
+			path:            "bin/tool",
+			unchanged:       true,
+			metadataChanged: true,
+		},
+		"should detect changed symlink target": {
+			modify: func(t *testing.T, root string) {
+				require.NoError(t, os.Remove(filepath.Join(root, "link")))
+				require.NoError(t, os.Symlink("bin", filepath.Join(root, "link")))
+			},
+			path:            "link",
+			unchanged:       false,
+			metadataChanged: true,
+		},
+		"should detect directory mode change": {
+			modify: func(t *testing.T, root string) {
+				require.NoError(t, os.Chmod(filepath.Join(root, "bin"), 0o750))
+			},
+			path:            "bin",
+			unchanged:       true,
+			metadataChanged: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// given
+			original := writeMetadataTestTree(t, content, modTime)
+			updated := writeMetadataTestTree(t, content, modTime)
+			tc.modify(t, updated)
+			target := filepath.Join(t.TempDir(), "target")
+
+			// when
+			delta, err := TreeDiff(original, updated, uint64(1024))
+			require.NoError(t, err)
+			err = ApplyTree(original, target, delta)
+
+			// then
+			require.NoError(t, err)
+			for _, file := range delta.Files {
+				if file.Path == tc.path {
+					assert.Equal(t, tc.unchanged, file.Unchanged)
+					assert.Equal(t, tc.metadataChanged, file.MetadataChanged)
+					assert.Empty(t, file.Segments)
+				}
+			}
+			assertSameTrees(t, updated, target)
+		})
+	}
+}
+
+func writeMetadataTestTree(t *testing.T, content []byte, modTime time.Time) string {
+	root := t.TempDir()
+	toolPath := filepath.Join(root, "bin", "tool")
+	require.NoError(t, os.Mkdir(filepath.Join(root, "bin"), 0o755))
+	require.NoError(t, os.WriteFile(toolPath, content, 0o755))
+	require.NoError(t, os.Symlink("bin/tool", filepath.Join(root, "link")))
+	require.NoError(t, os.Chtimes(toolPath, modTime, modTime))
+	require.NoError(t, os.Chtimes(filepath.Join(root, "bin"), modTime, modTime))
+	return root
+}
+
+func assertSameTrees(t *testing.T, expected, actual string) {
+	expectedPaths, expectedMetadata, err := listEntries(expected)
+	require.NoError(t, err)
+	actualPaths, actualMetadata, err := listEntries(actual)
+	require.NoError(t, err)
+
+	require.Equal(t, expectedPaths, actualPaths)
+	for _, path := range expectedPaths {
+		assert.Truef(t, expectedMetadata[path].Equal(actualMetadata[path]), "metadata of %s differs: %+v != %+v",
+			path, expectedMetadata[path], actualMetadata[path])
+	}
+	assert.Equal(t, readTestTree(t, expected), readTestTree(t, actual))
+}
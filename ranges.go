@@ -0,0 +1,141 @@
+package filediff
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Range is a continuous part of the file
+type Range struct {
+	// Offset point to starting position in the file
+	Offset int
+	// Length define how long range is
+	Length int
+}
+
+// signatureEntry is exported form of a chunk, it has no data
+type signatureEntry struct {
+	Offset int
+	Length int
+	Hash   string
+}
+
+// DiffChunks returns Delta between two files described only by their chunks (e.g. read with ReadSignature
+// or from store manifests), same as FileDiff would return for the files. Chunk data is not needed,
+// so chunks of the Delta have no data
+func DiffChunks(original, updated []Chunk) *Delta {
+	originalSignature := make(signature, len(original))
+	for _, chunk := range original {
+		if _, ok := originalSignature[chunk.Hash]; !ok {
+			originalSignature[chunk.Hash] = withoutData(chunk)
+		}
+	}
+
+	delta := &Delta{Reused: make([]Chunk, 0), Changed: make([]Chunk, 0)}
+	seen := make(map[string]struct{}, len(updated))
+	for _, chunk := range updated {
+		if _, ok := seen[chunk.Hash]; ok {
+			continue
+		}
+		seen[chunk.Hash] = struct{}{}
+
+		if originalChunk, ok := originalSignature[chunk.Hash]; ok {
+			delta.Reused = append(delta.Reused, originalChunk)
+			continue
+		}
+		delta.Changed = append(delta.Changed, withoutData(chunk))
+	}
+
+	return delta
+}
+
+// ChangedRanges returns byte ranges of updated file which are not present in original file, ordered by offset.
+// Adjacent changed chunks are merged into a single range. Ranges removed from original file are
+// returned when arguments are swapped. Only hashes, offsets and lengths of chunks are used
+func ChangedRanges(original, updated []Chunk) []Range {
+	originalHashes := make(map[string]struct{}, len(original))
+	for _, chunk := range original {
+		originalHashes[chunk.Hash] = struct{}{}
+	}
+
+	ranges := make([]Range, 0)
+	for _, chunk := range updated {
+		if _, ok := originalHashes[chunk.Hash]; ok {
+			continue
+		}
+		if last := len(ranges) - 1; last >= 0 && ranges[last].Offset+ranges[last].Length == chunk.Offset {
+			ranges[last].Length += chunk.Length
+			continue
+		}
+		ranges = append(ranges, Range{Offset: chunk.Offset, Length: chunk.Length})
+	}
+
+	return ranges
+}
+
+// WriteSignature writes chunks (without their data) to w, so file can be later compared
+// with DiffChunks or ChangedRanges without access to its content. Only WithSigningKey and WithEncryption options apply
+func WriteSignature(w io.Writer, chunks []Chunk, opts ...EncodeOption) error {
+	options := encodeOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	entries := make([]signatureEntry, 0, len(chunks))
+	for _, chunk := range chunks {
+		entries = append(entries, signatureEntry{Offset: chunk.Offset, Length: chunk.Length, Hash: chunk.Hash})
+	}
+	payload, err := json.Marshal(entries)
+	if err != nil {
+		return fmt.Errorf("failed to write signature: %w", err)
+	}
+
+	sealed, err := encrypted(w, options.recipients)
+	if err != nil {
+		return err
+	}
+	if options.signingKey == nil {
+		if _, err = sealed.Write(append(payload, '\n')); err != nil {
+			return fmt.Errorf("failed to write signature: %w", err)
+		}
+	} else if err = writeSigned(sealed, payload, options.signingKey); err != nil {
+		return err
+	}
+	return sealed.Close()
+}
+
+// ReadSignature reads chunks written with WriteSignature. Chunks have no data. Signature is decrypted and verified
+// the same way as DecodeDelta does, only WithDecryptionKey and WithTrustedKeys options apply
+func ReadSignature(r io.Reader, opts ...DecodeOption) ([]Chunk, error) {
+	options := decodeOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	br, err := decrypted(bufio.NewReader(r), options.decryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	if br, err = verified(br, options.trustedKeys); err != nil {
+		return nil, err
+	}
+
+	entries := make([]signatureEntry, 0)
+	if err := json.NewDecoder(br).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("failed to read signature: %w", err)
+	}
+
+	chunks := make([]Chunk, 0, len(entries))
+	for _, entry := range entries {
+		chunks = append(chunks, Chunk{Offset: entry.Offset, Length: entry.Length, Hash: entry.Hash})
+	}
+
+	return chunks, nil
+}
+
+func withoutData(chunk Chunk) Chunk {
+	chunk.Data = nil
+	return chunk
+}
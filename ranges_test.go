@@ -0,0 +1,113 @@
+package filediff
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChangedRanges(t *testing.T) {
+	original := randomData(1, 256*1024)
+	modifiedInMiddle := append(append(append([]byte{}, original[:100*1024]...), randomData(2, 100)...), original[100*1024:]...)
+	appended := append(append([]byte{}, original...), randomData(3, 1000)...)
+
+	testCases := map[string]struct {
+		updated []byte
+		// changed is position in updated data which must be covered by changed range, -1 if nothing changed
+		changed int
+		// maxChanged is upper bound of changed bytes
+		maxChanged int
+	}{
+		"should find no changed ranges for the same data": {
+			updated:    original,
+			changed:    -1,
+			maxChanged: 0,
+		},
+		"should find changed range in the middle": {
+			updated:    modifiedInMiddle,
+			changed:    100*1024 + 50,
+			maxChanged: 32 * 1024,
+		},
+		"should find changed range at the end": {
+			updated:    appended,
+			changed:    len(appended) - 1,
+			maxChanged: 32 * 1024,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// given
+			originalChunks, err := Split(original, 4096)
+			require.NoError(t, err)
+			updatedChunks, err := Split(tc.updated, 4096)
+			require.NoError(t, err)
+
+			// when
+			ranges := ChangedRanges(withoutChunksData(originalChunks), withoutChunksData(updatedChunks))
+
+			// then
+			changedBytes := 0
+			covered := false
+			for i, r := range ranges {
+				changedBytes += r.Length
+				covered = covered || (r.Offset <= tc.changed && tc.changed < r.Offset+r.Length)
+				if i > 0 {
+					// adjacent ranges are merged
+					assert.Less(t, ranges[i-1].Offset+ranges[i-1].Length, r.Offset)
+				}
+			}
+			assert.LessOrEqual(t, changedBytes, tc.maxChanged)
+			assert.Equal(t, tc.changed >= 0, covered)
+		})
+	}
+}
+
+func TestDiffChunks(t *testing.T) {
+	// given
+	original := randomData(1, 256*1024)
+	updated := append(append(append([]byte{}, original[:100*1024]...), randomData(2, 100)...), original[100*1024:]...)
+	originalFile, err := createTempTestFile(original, "original")
+	require.NoError(t, err)
+	updatedFile, err := createTempTestFile(updated, "updated")
+	require.NoError(t, err)
+	originalChunks, err := Split(original, 4096)
+	require.NoError(t, err)
+	updatedChunks, err := Split(updated, 4096)
+	require.NoError(t, err)
+
+	// when
+	delta := DiffChunks(withoutChunksData(originalChunks), withoutChunksData(updatedChunks))
+
+	// then
+	fileDelta, err := FileDiff(originalFile, updatedFile, 4096)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, withoutChunksData(fileDelta.Reused), delta.Reused)
+	assert.ElementsMatch(t, withoutChunksData(fileDelta.Changed), delta.Changed)
+}
+
+func TestSignature(t *testing.T) {
+	// given
+	chunks, err := Split(randomData(1, 64*1024), 4096)
+	require.NoError(t, err)
+	buffer := &bytes.Buffer{}
+
+	// when
+	require.NoError(t, WriteSignature(buffer, chunks))
+	read, err := ReadSignature(buffer)
+
+	// then
+	require.NoError(t, err)
+	assert.Equal(t, withoutChunksData(chunks), read)
+	assert.Empty(t, ChangedRanges(chunks, read))
+}
+
+func withoutChunksData(chunks []Chunk) []Chunk {
+	result := make([]Chunk, 0, len(chunks))
+	for _, chunk := range chunks {
+		result = append(result, withoutData(chunk))
+	}
+	return result
+}
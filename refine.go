@@ -0,0 +1,110 @@
+package filediff
+
+import "encoding/binary"
+
+const (
+	// DefaultRefinementEffort is a reasonable limit of byte comparisons spent on a single changed region
+	DefaultRefinementEffort = 1 << 20
+	// minRefinedMatch is the shortest match refinement turns into a copy. Shorter copy costs more than literal data
+	minRefinedMatch = 8
+)
+
+// WithRefinement enables byte level diff inside changed chunks. Every insert is compared with the neighbouring
+// original region which wasn't matched by any chunk, and parts found there are copied instead of sent as literal data.
+// effort limits byte comparisons spent on a single insert, the rest of it stays literal when it's exhausted.
+// Refinement changes only Ops, Reused and Changed chunks stay the same
+func WithRefinement(effort int) DiffOption {
+	return func(o *diffOptions) {
+		o.refinementEffort = effort
+	}
+}
+
+// refine replaces inserts with fine-grained copies and inserts against neighbouring original regions
+func refine(ops []Op, original []byte, effort int) []Op {
+	refined := make([]Op, 0, len(ops))
+	for i, op := range ops {
+		if op.Type != OpInsert {
+			refined = appendCopy(refined, op.Offset, op.Length)
+			continue
+		}
+
+		start, end := unmatchedRegion(ops, i, len(original))
+		refined = refineInsert(refined, op.Data, original[start:end], start, effort)
+	}
+
+	return refined
+}
+
+// unmatchedRegion returns original region between copies surrounding insert at index i, where data
+// replaced by the insert most likely was. When copies aren't in original order, region following
+// the previous copy is used instead
+func unmatchedRegion(ops []Op, i int, baseSize int) (int, int) {
+	start, end := 0, baseSize
+	if i > 0 && ops[i-1].Type == OpCopy {
+		start = ops[i-1].Offset + ops[i-1].Length
+	}
+	if i+1 < len(ops) && ops[i+1].Type == OpCopy {
+		end = ops[i+1].Offset
+	}
+	if end <= start {
+		end = start + 2*ops[i].Length
+		if end > baseSize {
+			end = baseSize
+		}
+	}
+
+	return start, end
+}
+
+// refineInsert appends ops producing data, copying parts of it found in region which starts at regionOffset
+// of the original file
+func refineInsert(ops []Op, data, region []byte, regionOffset, effort int) []Op {
+	if len(region) < minRefinedMatch || len(data) < minRefinedMatch {
+		return appendInsert(ops, data)
+	}
+	// indexing is a part of the effort as well
+	if len(region) > effort {
+		region = region[:effort]
+	}
+
+	// positions of every minRefinedMatch bytes of region
+	index := make(map[uint64][]int, len(region))
+	for position := 0; position+minRefinedMatch <= len(region); position++ {
+		key := binary.LittleEndian.Uint64(region[position:])
+		index[key] = append(index[key], position)
+	}
+
+	literalStart := 0
+	for position := 0; position+minRefinedMatch <= len(data) && effort > 0; {
+		bestOffset, bestLength := 0, 0
+		for _, candidate := range index[binary.LittleEndian.Uint64(data[position:])] {
+			length := 0
+			for position+length < len(data) && candidate+length < len(region) && data[position+length] == region[candidate+length] {
+				length++
+			}
+			effort -= length + 1
+			if length > bestLength {
+				bestOffset, bestLength = candidate, length
+			}
+			if effort <= 0 {
+				break
+			}
+		}
+		if bestLength < minRefinedMatch {
+			position++
+			continue
+		}
+
+		if position > literalStart {
+			ops = appendInsert(ops, data[literalStart:position])
+		}
+		ops = appendCopy(ops, regionOffset+bestOffset, bestLength)
+		position += bestLength
+		literalStart = position
+	}
+	if literalStart < len(data) {
+		ops = appendInsert(ops, data[literalStart:])
+	}
+
+	return ops
+}
@@ -0,0 +1,71 @@
+package filediff
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRefinement(t *testing.T) {
+	text := []byte("Hello everyone, this will be a very short text about nothing. Its only purpose is for testing. Testing should be sufficient. Yay")
+	original := randomData(1, 256*1024)
+	scattered := append([]byte{}, original...)
+	for _, offset := range []int{1000, 70 * 1024, 200 * 1024} {
+		scattered[offset] ^= 0xff
+	}
+
+	testCases := map[string]struct {
+		original []byte
+		updated  []byte
+		effort   int
+		// maxLiteral is upper bound of literal data in delta
+		maxLiteral int
+	}{
+		"should send only changed byte of short text": {
+			original:   text,
+			updated:    []byte("Hello evbryone, this will be a very short text about nothing. Its only purpose is for testing. Testing should be sufficient. Yay"),
+			effort:     DefaultRefinementEffort,
+			maxLiteral: 8,
+		},
+		"should send only changed bytes of scattered edits": {
+			original:   original,
+			updated:    scattered,
+			effort:     DefaultRefinementEffort,
+			maxLiteral: 3 * 16,
+		},
+		"should send inserted text": {
+			original:   text,
+			updated:    []byte("Hello everyone, this will be a very short and boring text about nothing. Its only purpose is for testing. Testing should be sufficient. Yay"),
+			effort:     DefaultRefinementEffort,
+			maxLiteral: len(" and boring") + 8,
+		},
+		"should keep literal data when effort is exhausted": {
+			original:   original,
+			updated:    scattered,
+			effort:     1,
+			maxLiteral: len(scattered),
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// when
+			delta, err := Diff(tc.original, tc.updated, 64, WithRefinement(tc.effort))
+
+			// then
+			require.NoError(t, err)
+			literal := 0
+			for _, op := range delta.Ops {
+				if op.Type == OpInsert {
+					literal += op.Length
+				}
+			}
+			assert.LessOrEqual(t, literal, tc.maxLiteral)
+			patched := &bytes.Buffer{}
+			require.NoError(t, Patch(bytes.NewReader(tc.original), delta, patched))
+			assert.Equal(t, string(tc.updated), patched.String())
+		})
+	}
+}
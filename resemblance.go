@@ -0,0 +1,149 @@
+package filediff
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+const (
+	// featureWindow is number of bytes hashed at every position of a chunk when computing its features
+	featureWindow = 8
+	// superFeatureCount is number of super-features of a chunk, chunks sharing any of them are similar
+	superFeatureCount = 4
+	// featuresPerSuperFeature is number of features grouped into a single super-feature
+	featuresPerSuperFeature = 2
+	// minResemblanceSize is the smallest literal data for which similar original chunk is searched
+	minResemblanceSize = 64
+)
+
+// featureTransforms are random linear transformations, each one produces a different feature of a chunk
+var featureTransforms = func() [superFeatureCount * featuresPerSuperFeature][2]uint64 {
+	var transforms [superFeatureCount * featuresPerSuperFeature][2]uint64
+	seed := uint64(0x9e3779b97f4a7c15)
+	for i := range transforms {
+		for j := range transforms[i] {
+			seed = splitMix64(seed)
+			transforms[i][j] = seed | 1
+		}
+	}
+	return transforms
+}()
+
+// WithResemblance enables encoding of changed data against the most similar original chunk. Similar chunks are found
+// with super-features (groups of maximal values of transformed rolling fingerprints, as in Finesse or Shilane's work), so
+// edited data which moved to a different position is still copied from the original file, except the edited bytes.
+// Resemblance changes only Ops, Reused and Changed chunks stay the same
+func WithResemblance() DiffOption {
+	return func(o *diffOptions) {
+		o.resemblance = true
+	}
+}
+
+// resemble replaces inserts with copies and inserts against the most similar original chunks
+func resemble(ops []Op, originalSignature signature, original []byte, chunkSize uint64, effort int) []Op {
+	originalChunks := make([]Chunk, 0, len(originalSignature))
+	for _, chunk := range originalSignature {
+		originalChunks = append(originalChunks, chunk)
+	}
+	// signature is a map, chunks are ordered so similar chunks are always chosen the same way
+	sort.Slice(originalChunks, func(i, j int) bool {
+		return originalChunks[i].Offset < originalChunks[j].Offset
+	})
+	index := make(map[uint64][]int)
+	for i, chunk := range originalChunks {
+		for _, superFeature := range superFeatures(chunk.Data) {
+			index[superFeature] = append(index[superFeature], i)
+		}
+	}
+
+	resembled := make([]Op, 0, len(ops))
+	for _, op := range ops {
+		if op.Type != OpInsert || op.Length < minResemblanceSize {
+			resembled = appendOp(resembled, op)
+			continue
+		}
+
+		// insert might be made of many changed chunks, each of them can be similar to a different original chunk
+		for _, chunk := range splitChunks(op.Data, chunkSize) {
+			similar, ok := mostSimilar(index, chunk.Data)
+			if !ok {
+				resembled = appendInsert(resembled, chunk.Data)
+				continue
+			}
+			// chunk boundaries of edited data rarely match the original ones, so neighbourhood of the similar
+			// chunk is used as well
+			start, end := originalChunks[similar].Offset-chunk.Length, originalChunks[similar].Offset+originalChunks[similar].Length+chunk.Length
+			if start < 0 {
+				start = 0
+			}
+			if end > len(original) {
+				end = len(original)
+			}
+			resembled = refineInsert(resembled, chunk.Data, original[start:end], start, effort)
+		}
+	}
+
+	return resembled
+}
+
+// mostSimilar returns index of the original chunk which shares the most super-features with data
+func mostSimilar(index map[uint64][]int, data []byte) (int, bool) {
+	if len(data) < minResemblanceSize {
+		return 0, false
+	}
+
+	shared := make(map[int]int)
+	best, bestShared := 0, 0
+	for _, superFeature := range superFeatures(data) {
+		for _, candidate := range index[superFeature] {
+			shared[candidate]++
+			if shared[candidate] > bestShared || (shared[candidate] == bestShared && candidate < best) {
+				best, bestShared = candidate, shared[candidate]
+			}
+		}
+	}
+
+	return best, bestShared > 0
+}
+
+// superFeatures returns super-features of data. Every feature is the maximal value of a fingerprint of all
+// featureWindow long windows of data, transformed with a different linear transformation. Single edit changes
+// only few fingerprints, so it rarely changes a maximum and similar data shares most of the features
+func superFeatures(data []byte) [superFeatureCount]uint64 {
+	var features [superFeatureCount * featuresPerSuperFeature]uint64
+	for position := 0; position+featureWindow <= len(data); position++ {
+		fingerprint := splitMix64(binary.LittleEndian.Uint64(data[position:]))
+		for i, transform := range featureTransforms {
+			if value := fingerprint*transform[0] + transform[1]; value > features[i] {
+				features[i] = value
+			}
+		}
+	}
+
+	var superFeatures [superFeatureCount]uint64
+	for i := range superFeatures {
+		// index is mixed in, so equal groups of features don't produce the same super-feature
+		value := uint64(i)
+		for _, feature := range features[i*featuresPerSuperFeature : (i+1)*featuresPerSuperFeature] {
+			value = splitMix64(value ^ feature)
+		}
+		superFeatures[i] = value
+	}
+
+	return superFeatures
+}
+
+func splitMix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// appendOp appends op, merging it with the previous one when possible
+func appendOp(ops []Op, op Op) []Op {
+	if op.Type == OpCopy {
+		return appendCopy(ops, op.Offset, op.Length)
+	}
+	return appendInsert(ops, op.Data)
+}
@@ -0,0 +1,82 @@
+package filediff
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResemblance(t *testing.T) {
+	original := randomData(1, 256*1024)
+	// record is a part of the original file, edited in few places
+	record := append([]byte{}, original[10*1024:14*1024]...)
+	for i := 100; i < len(record); i += 700 {
+		record[i] ^= 0xff
+	}
+	moved := append(append(append(append([]byte{}, original[:10*1024]...), original[14*1024:200*1024]...), record...), original[200*1024:]...)
+
+	testCases := map[string]struct {
+		opts []DiffOption
+		// maxLiteral is upper bound of literal data in delta
+		maxLiteral int
+		// minLiteral is lower bound of literal data in delta
+		minLiteral int
+	}{
+		"should copy most of edited record moved to a different position": {
+			opts: []DiffOption{WithResemblance()},
+			// small changed chunks at the record boundaries don't resemble any original chunk
+			maxLiteral: 512,
+		},
+		"should copy edited record with refinement as well": {
+			opts:       []DiffOption{WithRefinement(DefaultRefinementEffort), WithResemblance()},
+			maxLiteral: 64,
+		},
+		"should send edited record without resemblance": {
+			opts:       []DiffOption{WithRefinement(DefaultRefinementEffort)},
+			minLiteral: 512,
+			maxLiteral: len(record),
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// when
+			delta, err := Diff(original, moved, 1024, tc.opts...)
+
+			// then
+			require.NoError(t, err)
+			literal := 0
+			for _, op := range delta.Ops {
+				if op.Type == OpInsert {
+					literal += op.Length
+				}
+			}
+			assert.LessOrEqual(t, literal, tc.maxLiteral)
+			assert.GreaterOrEqual(t, literal, tc.minLiteral)
+			patched := &bytes.Buffer{}
+			require.NoError(t, Patch(bytes.NewReader(original), delta, patched))
+			assert.Equal(t, string(moved), patched.String())
+		})
+	}
+
+	t.Run("should find similar data by super-features", func(t *testing.T) {
+		// given
+		similar := append([]byte{}, original[:2048]...)
+		similar[1000] ^= 0xff
+
+		// when
+		shared := 0
+		originalFeatures, similarFeatures, differentFeatures := superFeatures(original[:2048]), superFeatures(similar), superFeatures(randomData(2, 2048))
+		for i := range originalFeatures {
+			if originalFeatures[i] == similarFeatures[i] {
+				shared++
+			}
+			assert.NotEqual(t, originalFeatures[i], differentFeatures[i])
+		}
+
+		// then
+		assert.Greater(t, shared, 0)
+	})
+}
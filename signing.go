@@ -0,0 +1,145 @@
+package filediff
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// signedMagic starts every signed envelope. Envelope is magic, version, key ID, Ed25519 signature
+// and the signed payload (encoded delta or signature file) up to the end of data
+var signedMagic = []byte("FDSG")
+
+const (
+	signedVersion = 1
+	// keyIDSize is number of bytes of public key hash used as its ID
+	keyIDSize       = 8
+	signedHeaderLen = 4 + 1 + keyIDSize
+)
+
+var (
+	// ErrUnknownKey is returned when data is signed with a key which isn't trusted
+	ErrUnknownKey = errors.New("unknown signing key")
+	// ErrInvalidSignature is returned when signature doesn't match data or data isn't signed but it's required
+	ErrInvalidSignature = errors.New("invalid signature")
+	// ErrInvalidKey is returned when public key added to KeyRing isn't Ed25519 public key
+	ErrInvalidKey = errors.New("invalid public key")
+)
+
+// KeyRing holds trusted public keys of publishers by their key IDs. Keys can be rotated by adding the new key
+// before data is signed with it and removing the old one when nothing signed with it is in use
+type KeyRing map[string]ed25519.PublicKey
+
+// NewKeyRing returns KeyRing which trusts given keys
+func NewKeyRing(keys ...ed25519.PublicKey) (KeyRing, error) {
+	ring := make(KeyRing, len(keys))
+	for _, key := range keys {
+		if err := ring.Add(key); err != nil {
+			return nil, err
+		}
+	}
+	return ring, nil
+}
+
+// Add trusts key. Key of other size than ed25519.PublicKeySize is rejected, it would make verification panic
+func (k KeyRing) Add(key ed25519.PublicKey) error {
+	if len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("%w: %d bytes", ErrInvalidKey, len(key))
+	}
+	k[KeyID(key)] = key
+	return nil
+}
+
+// Remove stops trusting key with id
+func (k KeyRing) Remove(id string) {
+	delete(k, id)
+}
+
+// KeyID returns hex encoded ID of public key, which is recorded in signed data
+func KeyID(key ed25519.PublicKey) string {
+	keyHash := sha256.Sum256(key)
+	return hex.EncodeToString(keyHash[:keyIDSize])
+}
+
+// WithSigningKey signs encoded data with Ed25519 key. Signed data must be read with WithTrustedKeys
+func WithSigningKey(key ed25519.PrivateKey) EncodeOption {
+	return func(o *encodeOptions) {
+		o.signingKey = key
+	}
+}
+
+// WithTrustedKeys requires data to be signed with one of keys. Signature is verified before anything is decoded,
+// so nothing is patched from data which isn't authentic
+func WithTrustedKeys(keys KeyRing) DecodeOption {
+	return func(o *decodeOptions) {
+		o.trustedKeys = keys
+	}
+}
+
+// writeSigned writes payload in signed envelope. Header is signed together with payload, so key ID can't be swapped
+func writeSigned(w io.Writer, payload []byte, key ed25519.PrivateKey) error {
+	header := make([]byte, 0, signedHeaderLen)
+	header = append(append(header, signedMagic...), signedVersion)
+	id, err := hex.DecodeString(KeyID(key.Public().(ed25519.PublicKey)))
+	if err != nil {
+		return fmt.Errorf("failed to sign data: %w", err)
+	}
+	header = append(header, id...)
+	signature := ed25519.Sign(key, signedMessage(header, payload))
+
+	for _, part := range [][]byte{header, signature, payload} {
+		if _, err = w.Write(part); err != nil {
+			return fmt.Errorf("failed to write signed data: %w", err)
+		}
+	}
+	return nil
+}
+
+// readSigned reads whole signed envelope and returns its payload when signature is valid and made by trusted key
+func readSigned(r io.Reader, keys KeyRing) ([]byte, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signed data: %w", err)
+	}
+	if len(data) < signedHeaderLen+ed25519.SignatureSize || !bytes.Equal(data[:len(signedMagic)], signedMagic) {
+		return nil, fmt.Errorf("%w: data isn't signed", ErrInvalidSignature)
+	}
+	if version := data[len(signedMagic)]; version != signedVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidSignature, version)
+	}
+
+	header, signature, payload := data[:signedHeaderLen], data[signedHeaderLen:signedHeaderLen+ed25519.SignatureSize],
+		data[signedHeaderLen+ed25519.SignatureSize:]
+	id := hex.EncodeToString(header[len(signedMagic)+1:])
+	key, ok := keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, id)
+	}
+	if !ed25519.Verify(key, signedMessage(header, payload), signature) {
+		return nil, fmt.Errorf("%w: signed with key %s", ErrInvalidSignature, id)
+	}
+
+	return payload, nil
+}
+
+func signedMessage(header, payload []byte) []byte {
+	return append(append(make([]byte, 0, len(header)+len(payload)), header...), payload...)
+}
+
+// verified returns reader of payload of signed data read by r. Unsigned data is returned as is,
+// unless keys are given and signature is required
+func verified(r *bufio.Reader, keys KeyRing) (*bufio.Reader, error) {
+	if magic, _ := r.Peek(len(signedMagic)); keys == nil && !bytes.Equal(magic, signedMagic) {
+		return r, nil
+	}
+	payload, err := readSigned(r, keys)
+	if err != nil {
+		return nil, err
+	}
+	return bufio.NewReader(bytes.NewReader(payload)), nil
+}
@@ -0,0 +1,190 @@
+package filediff
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignedDelta(t *testing.T) {
+	original := randomData(1, 64*1024)
+	updated := append(append([]byte{}, original[:32*1024]...), randomData(2, 1000)...)
+	delta, err := Diff(original, updated, 1024)
+	require.NoError(t, err)
+	oldKey, newKey := testKey(1), testKey(2)
+	unsigned := &bytes.Buffer{}
+	require.NoError(t, delta.Encode(unsigned))
+
+	testCases := map[string]struct {
+		encode      func() []byte
+		trustedKeys KeyRing
+		expectedErr error
+	}{
+		"should patch delta signed with trusted key": {
+			encode:      signedDelta(t, delta, newKey),
+			trustedKeys: keyRing(t, newKey),
+		},
+		"should patch delta signed with rotated key still in key ring": {
+			encode:      signedDelta(t, delta, oldKey),
+			trustedKeys: keyRing(t, oldKey, newKey),
+		},
+		"should reject delta signed with unknown key": {
+			encode:      signedDelta(t, delta, oldKey),
+			trustedKeys: keyRing(t, newKey),
+			expectedErr: ErrUnknownKey,
+		},
+		"should reject signed delta without trusted keys": {
+			encode:      signedDelta(t, delta, newKey),
+			expectedErr: ErrUnknownKey,
+		},
+		"should reject unsigned delta when signature is required": {
+			encode:      unsigned.Bytes,
+			trustedKeys: keyRing(t, newKey),
+			expectedErr: ErrInvalidSignature,
+		},
+		"should reject tampered delta": {
+			encode: func() []byte {
+				encoded := signedDelta(t, delta, newKey)()
+				encoded[len(encoded)-1] ^= 1
+				return encoded
+			},
+			trustedKeys: keyRing(t, newKey),
+			expectedErr: ErrInvalidSignature,
+		},
+		"should reject delta with swapped key ID": {
+			encode: func() []byte {
+				encoded := signedDelta(t, delta, newKey)()
+				copy(encoded[len(signedMagic)+1:], mustDecodeHex(t, KeyID(oldKey.Public().(ed25519.PublicKey))))
+				return encoded
+			},
+			trustedKeys: keyRing(t, oldKey, newKey),
+			expectedErr: ErrInvalidSignature,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// given
+			encoded := tc.encode()
+
+			// when
+			decoded, err := DecodeDelta(bytes.NewReader(encoded), WithTrustedKeys(tc.trustedKeys))
+
+			// then
+			if tc.expectedErr != nil {
+				assert.ErrorIs(t, err, tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			patched := &bytes.Buffer{}
+			require.NoError(t, Patch(bytes.NewReader(original), decoded, patched))
+			assert.Equal(t, string(updated), patched.String())
+		})
+	}
+
+	t.Run("should reject delta signed with removed key", func(t *testing.T) {
+		// given
+		keys := keyRing(t, oldKey, newKey)
+		keys.Remove(KeyID(oldKey.Public().(ed25519.PublicKey)))
+
+		// when
+		_, err := DecodeDelta(bytes.NewReader(signedDelta(t, delta, oldKey)()), WithTrustedKeys(keys))
+
+		// then
+		assert.ErrorIs(t, err, ErrUnknownKey)
+	})
+}
+
+func TestKeyRing(t *testing.T) {
+	testCases := map[string]struct {
+		key ed25519.PublicKey
+	}{
+		"should reject empty key": {
+			key: nil,
+		},
+		"should reject truncated key": {
+			key: testKey(1).Public().(ed25519.PublicKey)[:ed25519.PublicKeySize-1],
+		},
+		"should reject private key used as public key": {
+			key: ed25519.PublicKey(testKey(1)),
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// when
+			_, newErr := NewKeyRing(tc.key)
+			addErr := KeyRing{}.Add(tc.key)
+
+			// then
+			assert.ErrorIs(t, newErr, ErrInvalidKey)
+			assert.ErrorIs(t, addErr, ErrInvalidKey)
+		})
+	}
+}
+
+func TestSignedSignature(t *testing.T) {
+	chunks, err := Split(randomData(1, 64*1024), 1024)
+	require.NoError(t, err)
+	key := testKey(1)
+	keys := keyRing(t, key)
+
+	t.Run("should read signed signature", func(t *testing.T) {
+		// given
+		signed := &bytes.Buffer{}
+		require.NoError(t, WriteSignature(signed, chunks, WithSigningKey(key)))
+
+		// when
+		read, err := ReadSignature(signed, WithTrustedKeys(keys))
+
+		// then
+		require.NoError(t, err)
+		assert.Equal(t, withoutChunksData(chunks), read)
+	})
+
+	t.Run("should reject tampered signature", func(t *testing.T) {
+		// given
+		signed := &bytes.Buffer{}
+		require.NoError(t, WriteSignature(signed, chunks, WithSigningKey(key)))
+		tampered := bytes.Replace(signed.Bytes(), []byte(chunks[0].Hash), []byte(chunks[1].Hash), 1)
+
+		// when
+		_, err := ReadSignature(bytes.NewReader(tampered), WithTrustedKeys(keys))
+
+		// then
+		assert.ErrorIs(t, err, ErrInvalidSignature)
+	})
+}
+
+func testKey(seed byte) ed25519.PrivateKey {
+	return ed25519.NewKeyFromSeed(bytes.Repeat([]byte{seed}, ed25519.SeedSize))
+}
+
+// keyRing returns KeyRing which trusts public keys of given private keys
+func keyRing(t *testing.T, keys ...ed25519.PrivateKey) KeyRing {
+	public := make([]ed25519.PublicKey, 0, len(keys))
+	for _, key := range keys {
+		public = append(public, key.Public().(ed25519.PublicKey))
+	}
+	ring, err := NewKeyRing(public...)
+	require.NoError(t, err)
+	return ring
+}
+
+func signedDelta(t *testing.T, delta *Delta, key ed25519.PrivateKey) func() []byte {
+	return func() []byte {
+		encoded := &bytes.Buffer{}
+		require.NoError(t, delta.Encode(encoded, WithCompression(CodecFlate, PerStream), WithSigningKey(key)))
+		return encoded.Bytes()
+	}
+}
+
+func mustDecodeHex(t *testing.T, value string) []byte {
+	decoded, err := hex.DecodeString(value)
+	require.NoError(t, err)
+	return decoded
+}
@@ -0,0 +1,338 @@
+package snapshot
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	filediff "file-diff"
+	"file-diff/store"
+)
+
+const (
+	// indexPrefix is a prefix of store names under which snapshot indexes are kept
+	indexPrefix = "snapshot-index/"
+	// filesPrefix is a prefix of store names under which content of snapshot files is kept
+	filesPrefix = "snapshot-files/"
+	idLayout    = "20060102T150405.000000000Z"
+)
+
+// ErrExists is returned when snapshot with the same id is already stored
+var ErrExists = errors.New("snapshot already exists")
+
+// Snapshot is an immutable, timestamped capture of a directory tree
+type Snapshot struct {
+	// ID identifies snapshot, it's derived from its time
+	ID string
+	// Time when snapshot was taken
+	Time time.Time
+	// Entries every entry of the tree (regular file, directory or symbolic link), ordered by path
+	Entries []Entry
+}
+
+// Entry is a single entry of the captured tree
+type Entry struct {
+	// Path of the entry relative to the tree root, slash separated
+	Path string
+	// Metadata of the entry
+	Metadata filediff.Metadata
+	// Object name under which file content is stored in the chunk store. Empty for directories and symbolic links
+	Object string
+}
+
+// Create captures directory tree under root into the chunk store as a new snapshot. Content of files is chunked
+// by the store, so only chunks which are not stored yet (e.g. by previous snapshots) take space
+func Create(st *store.Store, root string) (*Snapshot, error) {
+	now := time.Now().UTC()
+	snapshot := &Snapshot{ID: now.Format(idLayout), Time: now, Entries: make([]Entry, 0)}
+	if _, err := st.Manifest(indexPrefix + snapshot.ID); err == nil {
+		return nil, fmt.Errorf("snapshot %s: %w", snapshot.ID, ErrExists)
+	}
+
+	err := filepath.WalkDir(root, func(fullPath string, _ fs.DirEntry, err error) error {
+		if err != nil || fullPath == root {
+			return err
+		}
+		relative, err := filepath.Rel(root, fullPath)
+		if err != nil {
+			return err
+		}
+		entry := Entry{Path: filepath.ToSlash(relative)}
+		if entry.Metadata, err = filediff.ReadMetadata(fullPath); err != nil {
+			return err
+		}
+		if entry.Metadata.Mode.IsRegular() {
+			entry.Object = filesPrefix + snapshot.ID + "/" + entry.Path
+			if err = putFile(st, entry.Object, fullPath); err != nil {
+				return err
+			}
+		}
+		snapshot.Entries = append(snapshot.Entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to capture tree: %w", err)
+	}
+	sort.Slice(snapshot.Entries, func(i, j int) bool {
+		return snapshot.Entries[i].Path < snapshot.Entries[j].Path
+	})
+
+	index, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+	// index is stored last, so snapshot becomes visible only when it's complete
+	if _, err = st.Put(indexPrefix+snapshot.ID, bytes.NewReader(index)); err != nil {
+		return nil, err
+	}
+
+	return snapshot, nil
+}
+
+// List returns ids of all snapshots, from the oldest one
+func List(st *store.Store) ([]string, error) {
+	names, err := st.List()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0)
+	for _, name := range names {
+		if strings.HasPrefix(name, indexPrefix) {
+			ids = append(ids, strings.TrimPrefix(name, indexPrefix))
+		}
+	}
+	// ids are timestamps in fixed layout, so lexical order is chronological
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+// Load reads snapshot with given id
+func Load(st *store.Store, id string) (*Snapshot, error) {
+	buffer := &bytes.Buffer{}
+	if err := st.Get(indexPrefix+id, buffer); err != nil {
+		return nil, fmt.Errorf("failed to read snapshot %s: %w", id, err)
+	}
+
+	snapshot := &Snapshot{}
+	if err := json.Unmarshal(buffer.Bytes(), snapshot); err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot %s: %w", id, err)
+	}
+
+	return snapshot, nil
+}
+
+// Restore recreates snapshot with given id in the target directory, including entries metadata.
+// If paths are given, only those entries (and content of directories among them) are restored
+func Restore(st *store.Store, id, target string, paths ...string) error {
+	snapshot, err := Load(st, id)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(target, 0o755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	// directories metadata is restored at the end, otherwise creating their content would change it
+	directories := make([]Entry, 0)
+	for _, entry := range snapshot.Entries {
+		if !selected(entry.Path, paths) {
+			continue
+		}
+		targetPath, err := filediff.JoinLocal(target, entry.Path)
+		if err != nil {
+			return err
+		}
+		if err = os.MkdirAll(filepath.Dir(targetPath), 0o755); err != nil {
+			return fmt.Errorf("failed to create directory: %w", err)
+		}
+
+		switch {
+		case entry.Metadata.Mode.IsDir():
+			if err = os.Mkdir(targetPath, 0o700); err != nil && !os.IsExist(err) {
+				return fmt.Errorf("failed to create directory: %w", err)
+			}
+			directories = append(directories, entry)
+			continue
+		case entry.Metadata.Mode&os.ModeSymlink != 0:
+			if err = os.Symlink(entry.Metadata.Symlink, targetPath); err != nil {
+				return fmt.Errorf("failed to create symlink: %w", err)
+			}
+		default:
+			if err = getFile(st, entry.Object, targetPath); err != nil {
+				return err
+			}
+		}
+
+		if err = filediff.RestoreMetadata(targetPath, entry.Metadata); err != nil {
+			return err
+		}
+	}
+
+	for i := len(directories) - 1; i >= 0; i-- {
+		targetPath, err := filediff.JoinLocal(target, directories[i].Path)
+		if err != nil {
+			return err
+		}
+		if err = filediff.RestoreMetadata(targetPath, directories[i].Metadata); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// selected reports whether entry under entryPath is one of paths or is inside of any of them.
+// Empty paths select everything
+func selected(entryPath string, paths []string) bool {
+	if len(paths) == 0 {
+		return true
+	}
+	for _, p := range paths {
+		p = path.Clean(filepath.ToSlash(p))
+		if entryPath == p || strings.HasPrefix(entryPath, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func putFile(st *store.Store, name, fullPath string) error {
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return fmt.Errorf("failed to open a file: %w", err)
+	}
+	defer file.Close()
+
+	_, err = st.Put(name, file)
+	return err
+}
+
+func getFile(st *store.Store, name, targetPath string) (err error) {
+	file, err := os.Create(targetPath)
+	if err != nil {
+		return fmt.Errorf("failed to create a file: %w", err)
+	}
+	defer func() {
+		if closeErr := file.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("failed to close file: %w", closeErr)
+		}
+	}()
+
+	return st.Get(name, file)
+}
+
+// ChangeType describes how entry differs between two snapshots
+type ChangeType int
+
+const (
+	// Added entry exists only in the newer snapshot
+	Added ChangeType = iota + 1
+	// Removed entry exists only in the older snapshot
+	Removed
+	// Modified entry has different content (or type)
+	Modified
+	// MetadataChanged entry has the same content, but different metadata
+	MetadataChanged
+)
+
+// Change of a single entry between two snapshots
+type Change struct {
+	Path string
+	Type ChangeType
+	// Ranges of modified file in the newer snapshot which aren't present in the older one
+	Ranges []filediff.Range
+	// RemovedRanges of modified file in the older snapshot which aren't present in the newer one,
+	// e.g. deleted or truncated data
+	RemovedRanges []filediff.Range
+}
+
+// Diff returns changes between snapshots from and to, ordered by path. Content of files is compared
+// by chunk hashes of their manifests, so no file data is read
+func Diff(st *store.Store, from, to string) ([]Change, error) {
+	older, err := Load(st, from)
+	if err != nil {
+		return nil, err
+	}
+	newer, err := Load(st, to)
+	if err != nil {
+		return nil, err
+	}
+
+	olderEntries := make(map[string]Entry, len(older.Entries))
+	for _, entry := range older.Entries {
+		olderEntries[entry.Path] = entry
+	}
+
+	changes := make([]Change, 0)
+	for _, entry := range newer.Entries {
+		previous, ok := olderEntries[entry.Path]
+		if !ok {
+			changes = append(changes, Change{Path: entry.Path, Type: Added})
+			continue
+		}
+		delete(olderEntries, entry.Path)
+
+		sameContent, ranges, removedRanges, err := compareContent(st, previous, entry)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case !sameContent:
+			changes = append(changes, Change{Path: entry.Path, Type: Modified, Ranges: ranges, RemovedRanges: removedRanges})
+		case !previous.Metadata.Equal(entry.Metadata):
+			changes = append(changes, Change{Path: entry.Path, Type: MetadataChanged})
+		}
+	}
+	for entryPath := range olderEntries {
+		changes = append(changes, Change{Path: entryPath, Type: Removed})
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+
+	return changes, nil
+}
+
+// compareContent reports whether both entries are of the same type and have the same content.
+// If both are files with different content, ranges of b which aren't present in a and ranges of a
+// which aren't present in b are returned
+func compareContent(st *store.Store, a, b Entry) (bool, []filediff.Range, []filediff.Range, error) {
+	if a.Metadata.Mode.Type() != b.Metadata.Mode.Type() || a.Metadata.Symlink != b.Metadata.Symlink {
+		return false, nil, nil, nil
+	}
+	if a.Object == "" || b.Object == "" {
+		return a.Object == b.Object, nil, nil, nil
+	}
+
+	manifestA, err := st.Manifest(a.Object)
+	if err != nil {
+		return false, nil, nil, err
+	}
+	manifestB, err := st.Manifest(b.Object)
+	if err != nil {
+		return false, nil, nil, err
+	}
+	signatureA, signatureB := manifestA.Signature(), manifestB.Signature()
+	ranges := filediff.ChangedRanges(signatureA, signatureB)
+	removedRanges := filediff.ChangedRanges(signatureB, signatureA)
+	if manifestA.Size != manifestB.Size || len(manifestA.Chunks) != len(manifestB.Chunks) {
+		return false, ranges, removedRanges, nil
+	}
+	for i := range manifestA.Chunks {
+		if manifestA.Chunks[i] != manifestB.Chunks[i] {
+			return false, ranges, removedRanges, nil
+		}
+	}
+
+	return true, nil, nil, nil
+}
@@ -0,0 +1,247 @@
+package snapshot
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	filediff "file-diff"
+	"file-diff/store"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// maxIndexSize is upper bound of stored snapshot index of test trees
+const maxIndexSize = 4096
+
+func TestSnapshot(t *testing.T) {
+	version1 := randomData(1, 256*1024)
+	version2 := append(append([]byte{}, version1[:128*1024]...), randomData(2, 1000)...)
+
+	testCases := map[string]struct {
+		first   map[string][]byte
+		second  map[string][]byte
+		changes []Change
+		// maxIncrement is upper bound of chunk bytes stored by the second snapshot, besides its index
+		maxIncrement int
+	}{
+		"should store unchanged tree only once": {
+			first:        map[string][]byte{"a": version1, "dir/b": []byte("b")},
+			second:       map[string][]byte{"a": version1, "dir/b": []byte("b")},
+			changes:      []Change{},
+			maxIncrement: 0,
+		},
+		"should store only new chunks of modified file": {
+			first:        map[string][]byte{"a": version1},
+			second:       map[string][]byte{"a": version2},
+			changes:      []Change{{Path: "a", Type: Modified}},
+			maxIncrement: 32 * 1024,
+		},
+		"should report added and removed files": {
+			first:  map[string][]byte{"a": version1, "old/b": []byte("b")},
+			second: map[string][]byte{"a": version1, "new/b": []byte("b")},
+			changes: []Change{
+				{Path: "new", Type: Added},
+				{Path: "new/b", Type: Added},
+				{Path: "old", Type: Removed},
+				{Path: "old/b", Type: Removed},
+			},
+			maxIncrement: 0,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// given
+			storeRoot := t.TempDir()
+			st, err := store.Open(storeRoot, uint64(4096))
+			require.NoError(t, err)
+			tree := t.TempDir()
+			writeTestTree(t, tree, tc.first)
+			first, err := Create(st, tree)
+			require.NoError(t, err)
+			storedBefore := storedBytes(t, storeRoot)
+
+			// when
+			require.NoError(t, os.RemoveAll(tree))
+			writeTestTree(t, tree, tc.second)
+			second, err := Create(st, tree)
+			require.NoError(t, err)
+
+			// then
+			assert.LessOrEqual(t, storedBytes(t, storeRoot)-storedBefore, tc.maxIncrement+maxIndexSize)
+			ids, err := List(st)
+			require.NoError(t, err)
+			assert.Equal(t, []string{first.ID, second.ID}, ids)
+			changes, err := Diff(st, first.ID, second.ID)
+			require.NoError(t, err)
+			for i, change := range changes {
+				// ranges depend on chunk boundaries, only their presence is checked
+				assert.Equal(t, change.Type == Modified, len(change.Ranges)+len(change.RemovedRanges) > 0)
+				changes[i].Ranges = nil
+				changes[i].RemovedRanges = nil
+			}
+			assert.Equal(t, tc.changes, changes)
+			for id, files := range map[string]map[string][]byte{first.ID: tc.first, second.ID: tc.second} {
+				target := t.TempDir()
+				require.NoError(t, Restore(st, id, target))
+				assert.Equal(t, files, readTestTree(t, target))
+			}
+		})
+	}
+
+	t.Run("should restore single paths", func(t *testing.T) {
+		// given
+		st, err := store.Open(t.TempDir(), uint64(4096))
+		require.NoError(t, err)
+		tree := t.TempDir()
+		writeTestTree(t, tree, map[string][]byte{"a": version1, "dir/b": []byte("b"), "dir/c": []byte("c"), "d": []byte("d")})
+		require.NoError(t, os.Chmod(filepath.Join(tree, "d"), 0o600))
+		snapshot, err := Create(st, tree)
+		require.NoError(t, err)
+
+		// when
+		target := t.TempDir()
+		err = Restore(st, snapshot.ID, target, "dir", "d")
+
+		// then
+		require.NoError(t, err)
+		assert.Equal(t, map[string][]byte{"dir/b": []byte("b"), "dir/c": []byte("c"), "d": []byte("d")}, readTestTree(t, target))
+		info, err := os.Stat(filepath.Join(target, "d"))
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	})
+
+	t.Run("should report metadata change", func(t *testing.T) {
+		// given
+		st, err := store.Open(t.TempDir(), uint64(4096))
+		require.NoError(t, err)
+		tree := t.TempDir()
+		writeTestTree(t, tree, map[string][]byte{"a": []byte("a")})
+		first, err := Create(st, tree)
+		require.NoError(t, err)
+		require.NoError(t, os.Chmod(filepath.Join(tree, "a"), 0o600))
+		second, err := Create(st, tree)
+		require.NoError(t, err)
+
+		// when
+		changes, err := Diff(st, first.ID, second.ID)
+
+		// then
+		require.NoError(t, err)
+		assert.Equal(t, []Change{{Path: "a", Type: MetadataChanged}}, changes)
+	})
+
+	t.Run("should report removed ranges of truncated file", func(t *testing.T) {
+		// given
+		st, err := store.Open(t.TempDir(), uint64(4096))
+		require.NoError(t, err)
+		tree := t.TempDir()
+		writeTestTree(t, tree, map[string][]byte{"a": version1})
+		first, err := Create(st, tree)
+		require.NoError(t, err)
+		manifest, err := st.Manifest(first.Entries[0].Object)
+		require.NoError(t, err)
+		// truncate at chunk boundary, so no new data is left in the file
+		kept := manifest.Chunks[0].Length
+		require.NoError(t, os.Truncate(filepath.Join(tree, "a"), int64(kept)))
+		second, err := Create(st, tree)
+		require.NoError(t, err)
+
+		// when
+		changes, err := Diff(st, first.ID, second.ID)
+
+		// then
+		require.NoError(t, err)
+		require.Len(t, changes, 1)
+		assert.Equal(t, Modified, changes[0].Type)
+		assert.Empty(t, changes[0].Ranges)
+		assert.Equal(t, []filediff.Range{{Offset: kept, Length: len(version1) - kept}}, changes[0].RemovedRanges)
+	})
+
+	t.Run("should not restore entry outside of target", func(t *testing.T) {
+		// given
+		st, err := store.Open(t.TempDir(), uint64(4096))
+		require.NoError(t, err)
+		tree := t.TempDir()
+		writeTestTree(t, tree, map[string][]byte{"a": []byte("a")})
+		snapshot, err := Create(st, tree)
+		require.NoError(t, err)
+		snapshot.Entries[0].Path = "../escaped"
+		index, err := json.Marshal(snapshot)
+		require.NoError(t, err)
+		_, err = st.Put(indexPrefix+"tampered", bytes.NewReader(index))
+		require.NoError(t, err)
+		parent := t.TempDir()
+
+		// when
+		err = Restore(st, "tampered", filepath.Join(parent, "target"))
+
+		// then
+		assert.ErrorIs(t, err, filediff.ErrUnsafePath)
+		assert.NoFileExists(t, filepath.Join(parent, "escaped"))
+	})
+
+	t.Run("should not restore unknown snapshot", func(t *testing.T) {
+		st, err := store.Open(t.TempDir(), uint64(4096))
+		require.NoError(t, err)
+		assert.ErrorIs(t, Restore(st, "unknown", t.TempDir()), store.ErrNotFound)
+	})
+}
+
+func randomData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func writeTestTree(t *testing.T, root string, files map[string][]byte) {
+	for path, content := range files {
+		fullPath := filepath.Join(root, filepath.FromSlash(path))
+		require.NoError(t, os.MkdirAll(filepath.Dir(fullPath), 0o755))
+		require.NoError(t, os.WriteFile(fullPath, content, 0o644))
+	}
+	// fixed modification time, so rewritten trees have the same metadata
+	modTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	err := filepath.Walk(root, func(path string, _ os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Chtimes(path, modTime, modTime)
+	})
+	require.NoError(t, err)
+}
+
+func readTestTree(t *testing.T, root string) map[string][]byte {
+	files := make(map[string][]byte)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		relative, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(relative)], err = os.ReadFile(path)
+		return err
+	})
+	require.NoError(t, err)
+	return files
+}
+
+func storedBytes(t *testing.T, storeRoot string) int {
+	size := 0
+	err := filepath.Walk(filepath.Join(storeRoot, "chunks"), func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += int(info.Size())
+		}
+		return err
+	})
+	require.NoError(t, err)
+	return size
+}
@@ -0,0 +1,193 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// CheckReport summarizes store integrity check
+type CheckReport struct {
+	// Checked number of stored chunks which were rehashed
+	Checked int
+	// Broken hashes of chunks which content doesn't match their hash or can't be read
+	Broken []string
+	// Missing hashes of chunks referenced by manifests but not stored
+	Missing []string
+	// Orphaned hashes of stored chunks which are not referenced by any manifest. GC removes them
+	Orphaned []string
+	// Repaired hashes of broken or missing chunks restored from the repair store
+	Repaired []string
+	// Affected names of files which reference broken or missing chunks that were not repaired
+	Affected []string
+}
+
+// Check verifies store integrity. Every stored chunk (loose and packed) is rehashed against its strong hash
+// and every chunk referenced by manifests must be present. If repair store is given, good copies of broken
+// and missing chunks are copied from it. Store is locked exclusively for the whole check
+func (s *Store) Check(repair *Store) (*CheckReport, error) {
+	if repair != nil {
+		same, err := s.sameRoot(repair)
+		if err != nil {
+			return nil, err
+		}
+		// second Store opened on the same root would wait for the lock held by this one forever
+		if same {
+			return nil, errors.New("store can't be repaired from itself")
+		}
+	}
+
+	report := &CheckReport{
+		Broken:   make([]string, 0),
+		Missing:  make([]string, 0),
+		Orphaned: make([]string, 0),
+		Repaired: make([]string, 0),
+		Affected: make([]string, 0),
+	}
+	err := s.withLock(true, func() error {
+		references, err := s.references()
+		if err != nil {
+			return err
+		}
+		stored, err := s.storedChunks()
+		if err != nil {
+			return err
+		}
+
+		damaged := make(map[string]struct{})
+		for _, hash := range stored {
+			report.Checked++
+			if _, err := s.chunk(hash); err != nil {
+				report.Broken = append(report.Broken, hash)
+				damaged[hash] = struct{}{}
+			}
+			if _, ok := references[hash]; !ok {
+				report.Orphaned = append(report.Orphaned, hash)
+			}
+		}
+		for hash := range references {
+			// chunk under invalid hash can't be stored, so it's reported as missing
+			if has, err := s.Has(hash); err != nil && !errors.Is(err, ErrInvalidHash) {
+				return err
+			} else if !has {
+				report.Missing = append(report.Missing, hash)
+				damaged[hash] = struct{}{}
+			}
+		}
+		sort.Strings(report.Missing)
+
+		if repair != nil {
+			if err = s.repairChunks(repair, damaged, report); err != nil {
+				return err
+			}
+		}
+
+		affected := make(map[string]struct{})
+		for hash := range damaged {
+			for _, name := range references[hash] {
+				affected[name] = struct{}{}
+			}
+		}
+		for name := range affected {
+			report.Affected = append(report.Affected, name)
+		}
+		sort.Strings(report.Affected)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// repairChunks copies good copies of damaged chunks from repair store as loose chunks, which take precedence
+// over packed ones. Repaired chunks are removed from damaged
+func (s *Store) repairChunks(repair *Store, damaged map[string]struct{}, report *CheckReport) error {
+	return repair.withLock(false, func() error {
+		for hash := range damaged {
+			data, err := repair.chunk(hash)
+			if err != nil {
+				// repair store doesn't have good copy either
+				continue
+			}
+			path := s.chunkPath(hash)
+			if err = os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+				return fmt.Errorf("failed to create chunk directory: %w", err)
+			}
+			if err = writeFileAtomic(path, data); err != nil {
+				return err
+			}
+			report.Repaired = append(report.Repaired, hash)
+			delete(damaged, hash)
+		}
+		sort.Strings(report.Repaired)
+		return nil
+	})
+}
+
+// sameRoot reports whether other store is opened in the same directory, also under different path
+func (s *Store) sameRoot(other *Store) (bool, error) {
+	info, err := os.Stat(s.root)
+	if err != nil {
+		return false, fmt.Errorf("failed to stat store directory: %w", err)
+	}
+	otherInfo, err := os.Stat(other.root)
+	if err != nil {
+		return false, fmt.Errorf("failed to stat store directory: %w", err)
+	}
+
+	return os.SameFile(info, otherInfo), nil
+}
+
+// references maps every chunk referenced by manifests to names of files which reference it
+func (s *Store) references() (map[string][]string, error) {
+	names, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+
+	references := make(map[string][]string)
+	for _, name := range names {
+		manifest, err := s.Manifest(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, ref := range manifest.Chunks {
+			if files := references[ref.Hash]; len(files) == 0 || files[len(files)-1] != name {
+				references[ref.Hash] = append(files, name)
+			}
+		}
+	}
+
+	return references, nil
+}
+
+// storedChunks returns sorted hashes of all loose and packed chunks
+func (s *Store) storedChunks() ([]string, error) {
+	stored := make(map[string]struct{})
+	for hash := range s.packLocations() {
+		stored[hash] = struct{}{}
+	}
+	err := filepath.Walk(filepath.Join(s.root, chunksDir), func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && !strings.HasPrefix(info.Name(), tempPrefix) {
+			stored[info.Name()] = struct{}{}
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list chunks: %w", err)
+	}
+
+	hashes := make([]string, 0, len(stored))
+	for hash := range stored {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+
+	return hashes, nil
+}
@@ -0,0 +1,138 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheck(t *testing.T) {
+	files := map[string][]byte{
+		"v1": randomData(1, 64*1024),
+		"v2": randomData(2, 64*1024),
+	}
+
+	testCases := map[string]struct {
+		// damage breaks the store and returns number of damaged chunks
+		damage   func(t *testing.T, store *Store) int
+		repair   bool
+		broken   bool
+		missing  bool
+		orphaned bool
+		affected []string
+	}{
+		"should not report anything in healthy store": {
+			damage:   func(t *testing.T, store *Store) int { return 0 },
+			affected: []string{},
+		},
+		"should detect bit rot in loose chunk": {
+			damage: func(t *testing.T, store *Store) int {
+				path := store.chunkPath(firstChunk(t, store, "v1"))
+				data, err := os.ReadFile(path)
+				require.NoError(t, err)
+				data[0] ^= 0xff
+				require.NoError(t, os.WriteFile(path, data, 0o644))
+				return 1
+			},
+			broken:   true,
+			affected: []string{"v1"},
+		},
+		"should detect truncated pack": {
+			damage: func(t *testing.T, store *Store) int {
+				_, err := store.Pack(DefaultPackSize)
+				require.NoError(t, err)
+				for _, pack := range packFiles(t, store) {
+					require.NoError(t, os.Truncate(store.packPath(pack[:len(pack)-len(packExt)], packExt), 100))
+				}
+				return 1
+			},
+			broken:   true,
+			affected: []string{"v1", "v2"},
+		},
+		"should detect missing chunk": {
+			damage: func(t *testing.T, store *Store) int {
+				require.NoError(t, os.Remove(store.chunkPath(firstChunk(t, store, "v2"))))
+				return 1
+			},
+			missing:  true,
+			affected: []string{"v2"},
+		},
+		"should detect orphaned chunks": {
+			damage: func(t *testing.T, store *Store) int {
+				require.NoError(t, store.Delete("v2"))
+				return 0
+			},
+			orphaned: true,
+			affected: []string{},
+		},
+		"should repair broken and missing chunks from second store": {
+			damage: func(t *testing.T, store *Store) int {
+				path := store.chunkPath(firstChunk(t, store, "v1"))
+				require.NoError(t, os.WriteFile(path, []byte("garbage"), 0o644))
+				require.NoError(t, os.Remove(store.chunkPath(firstChunk(t, store, "v2"))))
+				return 2
+			},
+			repair:   true,
+			broken:   true,
+			missing:  true,
+			affected: []string{},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// given
+			store := storeWithFiles(t, files)
+			damaged := tc.damage(t, store)
+			var repair *Store
+			if tc.repair {
+				repair = storeWithFiles(t, files)
+			}
+
+			// when
+			report, err := store.Check(repair)
+
+			// then
+			require.NoError(t, err)
+			assert.Positive(t, report.Checked)
+			assert.Equal(t, tc.broken, len(report.Broken) > 0)
+			assert.Equal(t, tc.missing, len(report.Missing) > 0)
+			assert.Equal(t, tc.orphaned, len(report.Orphaned) > 0)
+			assert.Equal(t, tc.affected, report.Affected)
+			if tc.repair {
+				assert.Len(t, report.Repaired, damaged)
+				assertFiles(t, store, files)
+			}
+		})
+	}
+
+	t.Run("should not repair store from itself", func(t *testing.T) {
+		store := storeWithFiles(t, files)
+
+		_, err := store.Check(store)
+		assert.ErrorContains(t, err, "store can't be repaired from itself")
+	})
+
+	t.Run("should not repair store from another store on the same root", func(t *testing.T) {
+		// given
+		store := storeWithFiles(t, files)
+		sep := string(filepath.Separator)
+		same, err := Open(store.root+sep+chunksDir+sep+"..", uint64(4096))
+		require.NoError(t, err)
+
+		// when
+		_, err = store.Check(same)
+
+		// then
+		assert.ErrorContains(t, err, "store can't be repaired from itself")
+	})
+}
+
+func firstChunk(t *testing.T, store *Store, name string) string {
+	manifest, err := store.Manifest(name)
+	require.NoError(t, err)
+	return manifest.Chunks[0].Hash
+}
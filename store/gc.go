@@ -0,0 +1,96 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// GCReport summarizes garbage collection
+type GCReport struct {
+	// Manifests number of stored files which were marked
+	Manifests int
+	// References number of references to every live chunk
+	References map[string]int
+	// Removed hashes of chunks which are not referenced by any manifest. In dry run they are only reported
+	Removed []string
+	// RemovedBytes size of removed chunks
+	RemovedBytes int64
+}
+
+// GC frees chunks which are not referenced by any manifest, using mark and sweep. Mark phase counts
+// references of every chunk in all manifests, sweep phase removes chunks without references together with
+// leftovers of interrupted writes of chunks and packs. Packed chunks are removed from pack indexes, space they
+// take in pack files is reclaimed by Repack. With dryRun nothing is removed, only reported.
+// Store is locked exclusively for the whole collection, so concurrent writers wait for it to finish
+func (s *Store) GC(dryRun bool) (*GCReport, error) {
+	report := &GCReport{References: make(map[string]int), Removed: make([]string, 0)}
+	err := s.withLock(true, func() error {
+		if err := s.mark(report); err != nil {
+			return err
+		}
+		if err := s.sweep(report, dryRun); err != nil {
+			return err
+		}
+		if err := s.sweepTemporaryPacks(dryRun); err != nil {
+			return err
+		}
+		return s.sweepPacks(report, dryRun)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+func (s *Store) mark(report *GCReport) error {
+	names, err := s.List()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		manifest, err := s.Manifest(name)
+		if err != nil {
+			return err
+		}
+		for _, ref := range manifest.Chunks {
+			report.References[ref.Hash]++
+		}
+		report.Manifests++
+	}
+
+	return nil
+}
+
+func (s *Store) sweep(report *GCReport, dryRun bool) error {
+	err := filepath.Walk(filepath.Join(s.root, chunksDir), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		// nobody writes while store is locked exclusively, so temporary file is left by interrupted write
+		temporary := strings.HasPrefix(info.Name(), tempPrefix)
+		if !temporary {
+			if _, ok := report.References[info.Name()]; ok {
+				return nil
+			}
+			report.Removed = append(report.Removed, info.Name())
+			report.RemovedBytes += info.Size()
+		}
+		if dryRun {
+			return nil
+		}
+		if err = os.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove chunk: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to sweep chunks: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,139 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGC(t *testing.T) {
+	version1 := randomData(1, 256*1024)
+	version2 := append(append([]byte{}, version1[:128*1024]...), randomData(2, 128*1024)...)
+
+	testCases := map[string]struct {
+		deleted        []string
+		dryRun         bool
+		removedChunks  bool
+		remainingFiles []string
+	}{
+		"should not remove anything if all files are referenced": {
+			deleted:        []string{},
+			removedChunks:  false,
+			remainingFiles: []string{"v1", "v2"},
+		},
+		"should remove chunks of deleted version only": {
+			deleted:        []string{"v1"},
+			removedChunks:  true,
+			remainingFiles: []string{"v2"},
+		},
+		"should only report chunks in dry run": {
+			deleted:        []string{"v1"},
+			dryRun:         true,
+			removedChunks:  true,
+			remainingFiles: []string{"v2"},
+		},
+		"should remove all chunks when all files are deleted": {
+			deleted:        []string{"v1", "v2"},
+			removedChunks:  true,
+			remainingFiles: []string{},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// given
+			store, err := Open(t.TempDir(), uint64(4096))
+			require.NoError(t, err)
+			files := map[string][]byte{"v1": version1, "v2": version2}
+			for name, content := range files {
+				_, err = store.Put(name, createTempTestFile(t, content))
+				require.NoError(t, err)
+			}
+			for _, name := range tc.deleted {
+				require.NoError(t, store.Delete(name))
+			}
+			sizeBefore := storedBytes(t, store)
+
+			// when
+			report, err := store.GC(tc.dryRun)
+
+			// then
+			require.NoError(t, err)
+			assert.Equal(t, len(tc.remainingFiles), report.Manifests)
+			assert.Equal(t, tc.removedChunks, len(report.Removed) > 0)
+			if tc.dryRun {
+				assert.Equal(t, sizeBefore, storedBytes(t, store))
+			} else {
+				assert.Equal(t, int64(sizeBefore)-report.RemovedBytes, int64(storedBytes(t, store)))
+			}
+			for _, hash := range report.Removed {
+				has, err := store.Has(hash)
+				require.NoError(t, err)
+				assert.Equal(t, tc.dryRun, has)
+			}
+			for _, name := range tc.remainingFiles {
+				buffer := &bytes.Buffer{}
+				require.NoError(t, store.Get(name, buffer))
+				assert.Equal(t, files[name], buffer.Bytes())
+			}
+		})
+	}
+
+	t.Run("should remove leftovers of interrupted pack writes", func(t *testing.T) {
+		// given
+		store := storeWithFiles(t, map[string][]byte{"v1": version1})
+		_, err := store.Pack(DefaultPackSize)
+		require.NoError(t, err)
+		leftover, err := os.CreateTemp(filepath.Join(store.root, packsDir), tempPrefix)
+		require.NoError(t, err)
+		require.NoError(t, leftover.Close())
+
+		// when
+		_, err = store.GC(false)
+
+		// then
+		require.NoError(t, err)
+		assert.Empty(t, temporaryFiles(t, store))
+		assertFiles(t, store, map[string][]byte{"v1": version1})
+	})
+
+	t.Run("should not remove chunks of files stored concurrently", func(t *testing.T) {
+		// given
+		store, err := Open(t.TempDir(), uint64(4096))
+		require.NoError(t, err)
+		files := make(map[string][]byte)
+		for i := 0; i < 8; i++ {
+			files[fmt.Sprintf("file-%d", i)] = randomData(int64(i), 64*1024)
+		}
+
+		// when
+		wg := sync.WaitGroup{}
+		for name, content := range files {
+			wg.Add(2)
+			go func(name string, content []byte) {
+				defer wg.Done()
+				_, err := store.Put(name, createTempTestFile(t, content))
+				assert.NoError(t, err)
+			}(name, content)
+			go func() {
+				defer wg.Done()
+				_, err := store.GC(false)
+				assert.NoError(t, err)
+			}()
+		}
+		wg.Wait()
+
+		// then
+		for name, content := range files {
+			buffer := &bytes.Buffer{}
+			require.NoError(t, store.Get(name, buffer))
+			assert.Equal(t, content, buffer.Bytes())
+		}
+	})
+}
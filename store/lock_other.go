@@ -0,0 +1,8 @@
+//go:build !unix
+
+package store
+
+// lockFile is a no-op on systems without flock. Store is synchronized only within the process there
+func lockFile(path string, exclusive bool) (func() error, error) {
+	return func() error { return nil }, nil
+}
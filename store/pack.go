@@ -0,0 +1,472 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	packsDir       = "packs"
+	packExt        = ".pack"
+	indexExt       = ".idx"
+	generationFile = "generation"
+	// DefaultPackSize is a reasonable size of a single pack file
+	DefaultPackSize = 64 << 20
+)
+
+// packIndex maps chunk strong hash to its place in a single pack file
+type packIndex struct {
+	Chunks map[string]packEntry
+}
+
+type packEntry struct {
+	Offset int64
+	Length int
+}
+
+// packLocation points to the chunk inside the pack
+type packLocation struct {
+	pack string
+	packEntry
+}
+
+// Pack moves loose chunks (stored one file per chunk) into pack files no bigger than maxPackSize,
+// along with the index which maps chunk hash to (pack, offset, length). It returns number of packed chunks
+func (s *Store) Pack(maxPackSize int64) (int, error) {
+	packed := 0
+	err := s.withLock(true, func() error {
+		writer := s.newPackWriter(maxPackSize)
+		defer writer.abort()
+		loose := make([]string, 0)
+		err := filepath.Walk(filepath.Join(s.root, chunksDir), func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() || strings.HasPrefix(info.Name(), tempPrefix) {
+				return err
+			}
+			data, err := s.chunk(info.Name())
+			if err != nil {
+				return err
+			}
+			loose = append(loose, path)
+			return writer.add(info.Name(), data)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to pack chunks: %w", err)
+		}
+		if err = writer.close(); err != nil {
+			return err
+		}
+		if err = s.bumpGeneration(); err != nil {
+			return err
+		}
+
+		// chunks are safely in packs, loose copies are not needed anymore
+		for _, path := range loose {
+			if err = os.Remove(path); err != nil {
+				return fmt.Errorf("failed to remove packed chunk: %w", err)
+			}
+		}
+		packed = len(loose)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return packed, nil
+}
+
+// Repack consolidates sparse packs, which usually remain after GC. Every pack in which live chunks take less
+// than minUsage (0-1] of its size is rewritten together with other sparse packs into new packs no bigger than
+// maxPackSize. It returns number of rewritten packs
+func (s *Store) Repack(minUsage float64, maxPackSize int64) (int, error) {
+	repacked := 0
+	err := s.withLock(true, func() error {
+		usage, err := s.packUsage()
+		if err != nil {
+			return err
+		}
+
+		sparse := make(map[string]struct{})
+		for pack, ratio := range usage {
+			if ratio < minUsage {
+				sparse[pack] = struct{}{}
+			}
+		}
+		if len(sparse) == 0 {
+			return nil
+		}
+		repacked = len(sparse)
+
+		writer := s.newPackWriter(maxPackSize)
+		defer writer.abort()
+		for hash, location := range s.packLocations() {
+			if _, ok := sparse[location.pack]; !ok {
+				continue
+			}
+			data, err := s.chunk(hash)
+			if err != nil {
+				return err
+			}
+			if err = writer.add(hash, data); err != nil {
+				return err
+			}
+		}
+		if err = writer.close(); err != nil {
+			return err
+		}
+		// pack with the same content gets the same name, it must not be removed
+		for _, pack := range writer.written {
+			delete(sparse, pack)
+		}
+
+		for pack := range sparse {
+			s.forgetPack(pack)
+			if err = s.removePack(pack); err != nil {
+				return err
+			}
+		}
+		return s.bumpGeneration()
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return repacked, nil
+}
+
+// packUsage returns ratio of live chunks size to file size of every pack
+func (s *Store) packUsage() (map[string]float64, error) {
+	live := make(map[string]int64)
+	for _, location := range s.packLocations() {
+		live[location.pack] += int64(location.Length)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(s.root, packsDir))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list packs: %w", err)
+	}
+	usage := make(map[string]float64)
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), packExt) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat pack: %w", err)
+		}
+		pack := strings.TrimSuffix(entry.Name(), packExt)
+		usage[pack] = 1
+		if info.Size() > 0 {
+			usage[pack] = float64(live[pack]) / float64(info.Size())
+		}
+	}
+
+	return usage, nil
+}
+
+// sweepPacks removes chunks without references from pack indexes. Pack files become sparse until Repack,
+// only packs without any live chunk are removed
+func (s *Store) sweepPacks(report *GCReport, dryRun bool) error {
+	dirty := make(map[string]struct{})
+	for hash, location := range s.packLocations() {
+		if _, ok := report.References[hash]; ok {
+			continue
+		}
+		report.Removed = append(report.Removed, hash)
+		report.RemovedBytes += int64(location.Length)
+		dirty[location.pack] = struct{}{}
+	}
+	if dryRun || len(dirty) == 0 {
+		return nil
+	}
+
+	for _, hash := range report.Removed {
+		s.forgetChunk(hash)
+	}
+	for pack := range dirty {
+		index := s.packIndex(pack)
+		if len(index.Chunks) > 0 {
+			if err := s.writePackIndex(pack, index); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := s.removePack(pack); err != nil {
+			return err
+		}
+	}
+
+	return s.bumpGeneration()
+}
+
+// sweepTemporaryPacks removes leftovers of interrupted pack writes. Nobody writes while store is locked
+// exclusively, so every temporary file in packs directory is such leftover
+func (s *Store) sweepTemporaryPacks(dryRun bool) error {
+	if dryRun {
+		return nil
+	}
+	entries, err := os.ReadDir(filepath.Join(s.root, packsDir))
+	if err != nil {
+		return fmt.Errorf("failed to list packs: %w", err)
+	}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), tempPrefix) {
+			continue
+		}
+		if err = os.Remove(filepath.Join(s.root, packsDir, entry.Name())); err != nil {
+			return fmt.Errorf("failed to remove temporary pack: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// refreshPacks reloads pack indexes if other process changed packs since they were loaded
+func (s *Store) refreshPacks() error {
+	generation, err := s.readGeneration()
+	if err != nil {
+		return err
+	}
+
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+	if s.packs != nil && generation == s.generation {
+		return nil
+	}
+
+	entries, err := os.ReadDir(filepath.Join(s.root, packsDir))
+	if err != nil {
+		return fmt.Errorf("failed to list packs: %w", err)
+	}
+	packs := make(map[string]packLocation)
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), indexExt) {
+			continue
+		}
+		pack := strings.TrimSuffix(entry.Name(), indexExt)
+		data, err := os.ReadFile(filepath.Join(s.root, packsDir, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to read pack index: %w", err)
+		}
+		index := packIndex{}
+		if err = json.Unmarshal(data, &index); err != nil {
+			return fmt.Errorf("failed to decode pack index %s: %w", pack, err)
+		}
+		for hash, entry := range index.Chunks {
+			packs[hash] = packLocation{pack: pack, packEntry: entry}
+		}
+	}
+	s.packs = packs
+	s.generation = generation
+
+	return nil
+}
+
+func (s *Store) readGeneration() (int, error) {
+	data, err := os.ReadFile(filepath.Join(s.root, packsDir, generationFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read packs generation: %w", err)
+	}
+	generation, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid packs generation: %w", err)
+	}
+
+	return generation, nil
+}
+
+// bumpGeneration records that packs changed, so other processes reload their indexes
+func (s *Store) bumpGeneration() error {
+	generation, err := s.readGeneration()
+	if err != nil {
+		return err
+	}
+	generation++
+	if err = writeFileAtomic(filepath.Join(s.root, packsDir, generationFile), []byte(strconv.Itoa(generation))); err != nil {
+		return err
+	}
+
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+	s.generation = generation
+	return nil
+}
+
+func (s *Store) packLocation(hash string) (packLocation, bool) {
+	s.indexMu.RLock()
+	defer s.indexMu.RUnlock()
+	location, ok := s.packs[hash]
+	return location, ok
+}
+
+// packLocations returns copy of the whole index, so it can be iterated while index changes
+func (s *Store) packLocations() map[string]packLocation {
+	s.indexMu.RLock()
+	defer s.indexMu.RUnlock()
+	locations := make(map[string]packLocation, len(s.packs))
+	for hash, location := range s.packs {
+		locations[hash] = location
+	}
+	return locations
+}
+
+func (s *Store) packIndex(pack string) packIndex {
+	index := packIndex{Chunks: make(map[string]packEntry)}
+	for hash, location := range s.packLocations() {
+		if location.pack == pack {
+			index.Chunks[hash] = location.packEntry
+		}
+	}
+	return index
+}
+
+func (s *Store) forgetChunk(hash string) {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+	delete(s.packs, hash)
+}
+
+func (s *Store) forgetPack(pack string) {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+	for hash, location := range s.packs {
+		if location.pack == pack {
+			delete(s.packs, hash)
+		}
+	}
+}
+
+func (s *Store) readPacked(hash string, location packLocation) ([]byte, error) {
+	file, err := os.Open(s.packPath(location.pack, packExt))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open pack %s: %w", location.pack, err)
+	}
+	defer file.Close()
+
+	data := make([]byte, location.Length)
+	if _, err = file.ReadAt(data, location.Offset); err != nil {
+		return nil, fmt.Errorf("failed to read chunk %s from pack %s: %w", hash, location.pack, err)
+	}
+
+	return data, nil
+}
+
+func (s *Store) writePackIndex(pack string, index packIndex) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return fmt.Errorf("failed to encode pack index %s: %w", pack, err)
+	}
+
+	return writeFileAtomic(s.packPath(pack, indexExt), data)
+}
+
+// removePack removes index first, so pack is never referenced by index while missing
+func (s *Store) removePack(pack string) error {
+	for _, ext := range []string{indexExt, packExt} {
+		if err := os.Remove(s.packPath(pack, ext)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove pack %s: %w", pack, err)
+		}
+	}
+	return nil
+}
+
+func (s *Store) packPath(pack, ext string) string {
+	return filepath.Join(s.root, packsDir, pack+ext)
+}
+
+// packWriter appends chunks to pack files. Pack is named after hash of its content
+// and becomes visible (its index is written) only when it's complete
+type packWriter struct {
+	store   *Store
+	maxSize int64
+
+	file  *os.File
+	hash  hash.Hash
+	size  int64
+	index packIndex
+	// written names of finished packs
+	written []string
+}
+
+func (s *Store) newPackWriter(maxSize int64) *packWriter {
+	return &packWriter{store: s, maxSize: maxSize}
+}
+
+func (pw *packWriter) add(chunkHash string, data []byte) error {
+	if pw.file != nil && pw.size+int64(len(data)) > pw.maxSize {
+		if err := pw.close(); err != nil {
+			return err
+		}
+	}
+	if pw.file == nil {
+		file, err := os.CreateTemp(filepath.Join(pw.store.root, packsDir), tempPrefix)
+		if err != nil {
+			return fmt.Errorf("failed to create pack: %w", err)
+		}
+		pw.file = file
+		pw.hash = sha256.New()
+		pw.size = 0
+		pw.index = packIndex{Chunks: make(map[string]packEntry)}
+	}
+
+	if _, err := io.MultiWriter(pw.file, pw.hash).Write(data); err != nil {
+		return fmt.Errorf("failed to write pack: %w", err)
+	}
+	pw.index.Chunks[chunkHash] = packEntry{Offset: pw.size, Length: len(data)}
+	pw.size += int64(len(data))
+
+	return nil
+}
+
+// abort removes current unfinished pack, if any. Finished packs are kept
+func (pw *packWriter) abort() {
+	if pw.file == nil {
+		return
+	}
+	pw.file.Close()
+	os.Remove(pw.file.Name())
+	pw.file = nil
+}
+
+// close finishes current pack, if any, and adds its chunks to the store index
+func (pw *packWriter) close() error {
+	if pw.file == nil {
+		return nil
+	}
+	file := pw.file
+	pw.file = nil
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("failed to close pack: %w", err)
+	}
+
+	pack := hex.EncodeToString(pw.hash.Sum(nil))
+	if err := os.Rename(file.Name(), pw.store.packPath(pack, packExt)); err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("failed to rename pack: %w", err)
+	}
+	if err := pw.store.writePackIndex(pack, pw.index); err != nil {
+		return err
+	}
+
+	pw.written = append(pw.written, pack)
+
+	pw.store.indexMu.Lock()
+	defer pw.store.indexMu.Unlock()
+	for hash, entry := range pw.index.Chunks {
+		pw.store.packs[hash] = packLocation{pack: pack, packEntry: entry}
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package store
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPack(t *testing.T) {
+	files := map[string][]byte{
+		"v1": randomData(1, 256*1024),
+		"v2": randomData(2, 256*1024),
+	}
+
+	testCases := map[string]struct {
+		maxPackSize int64
+		minPacks    int
+	}{
+		"should pack all chunks into single pack": {
+			maxPackSize: DefaultPackSize,
+			minPacks:    1,
+		},
+		"should split chunks into many packs": {
+			maxPackSize: 64 * 1024,
+			minPacks:    8,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// given
+			store := storeWithFiles(t, files)
+
+			// when
+			packed, err := store.Pack(tc.maxPackSize)
+
+			// then
+			require.NoError(t, err)
+			assert.Positive(t, packed)
+			assert.Equal(t, 0, storedBytes(t, store))
+			assert.GreaterOrEqual(t, len(packFiles(t, store)), tc.minPacks)
+			assertFiles(t, store, files)
+
+			// store opened again should read the same packs
+			reopened, err := Open(store.root, store.chunkSize)
+			require.NoError(t, err)
+			assertFiles(t, reopened, files)
+		})
+	}
+
+	t.Run("should not write chunks which are already packed", func(t *testing.T) {
+		// given
+		store := storeWithFiles(t, files)
+		_, err := store.Pack(DefaultPackSize)
+		require.NoError(t, err)
+
+		// when
+		_, err = store.Put("v1-copy", createTempTestFile(t, files["v1"]))
+
+		// then
+		require.NoError(t, err)
+		assert.Equal(t, 0, storedBytes(t, store))
+	})
+
+	t.Run("should see packs created by other store instance", func(t *testing.T) {
+		// given
+		store := storeWithFiles(t, files)
+		other, err := Open(store.root, store.chunkSize)
+		require.NoError(t, err)
+
+		// when
+		_, err = other.Pack(DefaultPackSize)
+
+		// then
+		require.NoError(t, err)
+		assertFiles(t, store, files)
+	})
+
+	t.Run("should not leave unfinished pack when packing fails", func(t *testing.T) {
+		// given
+		store := storeWithFiles(t, files)
+		chunks := make([]string, 0)
+		require.NoError(t, filepath.Walk(filepath.Join(store.root, chunksDir), func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				chunks = append(chunks, path)
+			}
+			return err
+		}))
+		// chunks are packed in walk order, so the last one fails after others were written
+		require.NoError(t, os.WriteFile(chunks[len(chunks)-1], []byte("corrupted"), 0o644))
+
+		// when
+		_, err := store.Pack(DefaultPackSize)
+
+		// then
+		assert.ErrorContains(t, err, "is corrupted")
+		assert.Empty(t, temporaryFiles(t, store))
+	})
+}
+
+func TestRepack(t *testing.T) {
+	files := map[string][]byte{
+		"v1": randomData(1, 256*1024),
+		"v2": randomData(2, 256*1024),
+	}
+
+	testCases := map[string]struct {
+		deleted  []string
+		minUsage float64
+		repacked int
+	}{
+		"should not repack full packs": {
+			deleted:  []string{},
+			minUsage: 0.9,
+			repacked: 0,
+		},
+		"should repack sparse pack after GC": {
+			deleted:  []string{"v1"},
+			minUsage: 0.9,
+			repacked: 1,
+		},
+		"should not repack pack with usage above minimal": {
+			deleted:  []string{"v1"},
+			minUsage: 0.1,
+			repacked: 0,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// given
+			store := storeWithFiles(t, files)
+			_, err := store.Pack(DefaultPackSize)
+			require.NoError(t, err)
+			remaining := make(map[string][]byte)
+			for name, content := range files {
+				remaining[name] = content
+			}
+			for _, name := range tc.deleted {
+				require.NoError(t, store.Delete(name))
+				delete(remaining, name)
+			}
+			_, err = store.GC(false)
+			require.NoError(t, err)
+			sizeBefore := packedBytes(t, store)
+
+			// when
+			repacked, err := store.Repack(tc.minUsage, DefaultPackSize)
+
+			// then
+			require.NoError(t, err)
+			assert.Equal(t, tc.repacked, repacked)
+			if tc.repacked > 0 {
+				assert.Less(t, packedBytes(t, store), sizeBefore)
+			}
+			assertFiles(t, store, remaining)
+		})
+	}
+}
+
+func storeWithFiles(t *testing.T, files map[string][]byte) *Store {
+	store, err := Open(t.TempDir(), uint64(4096))
+	require.NoError(t, err)
+	for name, content := range files {
+		_, err = store.Put(name, createTempTestFile(t, content))
+		require.NoError(t, err)
+	}
+	return store
+}
+
+func assertFiles(t *testing.T, store *Store, files map[string][]byte) {
+	for name, content := range files {
+		buffer := &bytes.Buffer{}
+		require.NoError(t, store.Get(name, buffer))
+		assert.Equal(t, content, buffer.Bytes())
+	}
+}
+
+func packFiles(t *testing.T, store *Store) []string {
+	entries, err := os.ReadDir(filepath.Join(store.root, packsDir))
+	require.NoError(t, err)
+	packs := make([]string, 0)
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), packExt) {
+			packs = append(packs, entry.Name())
+		}
+	}
+	return packs
+}
+
+func packedBytes(t *testing.T, store *Store) int64 {
+	size := int64(0)
+	for _, pack := range packFiles(t, store) {
+		info, err := os.Stat(filepath.Join(store.root, packsDir, pack))
+		require.NoError(t, err)
+		size += info.Size()
+	}
+	return size
+}
+
+func temporaryFiles(t *testing.T, store *Store) []string {
+	entries, err := os.ReadDir(filepath.Join(store.root, packsDir))
+	require.NoError(t, err)
+	temporary := make([]string, 0)
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), tempPrefix) {
+			temporary = append(temporary, entry.Name())
+		}
+	}
+	return temporary
+}
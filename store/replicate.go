@@ -0,0 +1,341 @@
+package store
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+)
+
+// maxChunksMessageSize limits how much chunk data is sent in a single message
+const maxChunksMessageSize = 4 << 20
+
+type messageType int
+
+const (
+	pushRequest messageType = iota + 1
+	pullRequest
+	manifestsMessage
+	wantMessage
+	chunksMessage
+	doneMessage
+	errorMessage
+	uploadRequest
+	haveMessage
+)
+
+// message is a single unit of replication and upload protocol. Only fields relevant for its type are set
+type message struct {
+	Type      messageType
+	Names     []string
+	Manifests []Manifest
+	Hashes    []string
+	Chunks    []chunkData
+	Error     string
+}
+
+type chunkData struct {
+	Hash string
+	Data []byte
+}
+
+// conn encodes and decodes protocol messages on both sides of the connection
+type conn struct {
+	enc *gob.Encoder
+	dec *gob.Decoder
+}
+
+func newConn(rw io.ReadWriter) *conn {
+	return &conn{enc: gob.NewEncoder(rw), dec: gob.NewDecoder(rw)}
+}
+
+func (c *conn) send(msg *message) error {
+	if err := c.enc.Encode(msg); err != nil {
+		return fmt.Errorf("failed to send message: %w", err)
+	}
+	return nil
+}
+
+// receive decodes next message and checks it's of expected type. Error reported by the other side is returned as error
+func (c *conn) receive(expected messageType) (*message, error) {
+	msg := &message{}
+	if err := c.dec.Decode(msg); err != nil {
+		return nil, fmt.Errorf("failed to receive message: %w", err)
+	}
+	if msg.Type == errorMessage {
+		return nil, fmt.Errorf("remote store: %s", msg.Error)
+	}
+	if msg.Type != expected {
+		return nil, fmt.Errorf("unexpected message type %d, expected %d", msg.Type, expected)
+	}
+	return msg, nil
+}
+
+// Push copies files stored under names to the remote store, which serves rw with Serve.
+// Remote store asks only for chunks it doesn't have, so only missing chunks are transferred.
+// rw can't be reused for another session
+func (s *Store) Push(rw io.ReadWriter, names ...string) error {
+	c := newConn(rw)
+	return s.withLock(false, func() error {
+		manifests := make([]Manifest, 0, len(names))
+		for _, name := range names {
+			manifest, err := s.Manifest(name)
+			if err != nil {
+				return err
+			}
+			manifests = append(manifests, *manifest)
+		}
+
+		if err := c.send(&message{Type: pushRequest, Manifests: manifests}); err != nil {
+			return err
+		}
+		want, err := c.receive(wantMessage)
+		if err != nil {
+			return err
+		}
+		if err = s.sendChunks(c, want.Hashes); err != nil {
+			return err
+		}
+		_, err = c.receive(doneMessage)
+		return err
+	})
+}
+
+// Pull copies files stored under names from the remote store, which serves rw with Serve.
+// Only chunks missing in this store are transferred. rw can't be reused for another session
+func (s *Store) Pull(rw io.ReadWriter, names ...string) error {
+	c := newConn(rw)
+	return s.withLock(false, func() error {
+		if err := c.send(&message{Type: pullRequest, Names: names}); err != nil {
+			return err
+		}
+		msg, err := c.receive(manifestsMessage)
+		if err != nil {
+			return err
+		}
+		// remote store must not overwrite other local files
+		requested := make(map[string]struct{}, len(names))
+		for _, name := range names {
+			requested[name] = struct{}{}
+		}
+		for _, manifest := range msg.Manifests {
+			if _, ok := requested[manifest.Name]; !ok {
+				return fmt.Errorf("received manifest of %s which was not requested", manifest.Name)
+			}
+		}
+		return s.receiveFiles(c, msg.Manifests)
+	})
+}
+
+// Serve handles single Push, Pull or Upload request of the remote side connected with rw.
+// Every session needs its own connection
+func (s *Store) Serve(rw io.ReadWriter) error {
+	c := newConn(rw)
+	msg := &message{}
+	if err := c.dec.Decode(msg); err != nil {
+		return fmt.Errorf("failed to receive message: %w", err)
+	}
+
+	var err error
+	switch msg.Type {
+	case pushRequest:
+		err = s.withLock(false, func() error {
+			return s.receiveFiles(c, msg.Manifests)
+		})
+	case pullRequest:
+		err = s.withLock(false, func() error {
+			return s.servePull(c, msg.Names)
+		})
+	case uploadRequest:
+		if len(msg.Names) != 1 {
+			err = fmt.Errorf("upload requires single file name, got %d", len(msg.Names))
+			break
+		}
+		err = s.withLock(false, func() error {
+			return s.serveUpload(c, msg.Names[0])
+		})
+	default:
+		err = fmt.Errorf("unexpected message type %d", msg.Type)
+	}
+	if err != nil {
+		// let the other side know, it might be waiting for a response
+		_ = c.send(&message{Type: errorMessage, Error: err.Error()})
+		return err
+	}
+
+	return nil
+}
+
+func (s *Store) servePull(c *conn, names []string) error {
+	manifests := make([]Manifest, 0, len(names))
+	for _, name := range names {
+		manifest, err := s.Manifest(name)
+		if err != nil {
+			return err
+		}
+		manifests = append(manifests, *manifest)
+	}
+	if err := c.send(&message{Type: manifestsMessage, Manifests: manifests}); err != nil {
+		return err
+	}
+
+	want, err := c.receive(wantMessage)
+	if err != nil {
+		return err
+	}
+	if err = s.sendChunks(c, want.Hashes); err != nil {
+		return err
+	}
+	_, err = c.receive(doneMessage)
+	return err
+}
+
+// receiveFiles asks for chunks of manifests which are missing in the store, stores received chunks
+// and then manifests. Store must be locked by the caller
+func (s *Store) receiveFiles(c *conn, manifests []Manifest) error {
+	lengths, err := chunkLengths(manifests)
+	if err != nil {
+		return err
+	}
+	missing, err := s.missingChunks(manifests)
+	if err != nil {
+		return err
+	}
+	if err = c.send(&message{Type: wantMessage, Hashes: missing}); err != nil {
+		return err
+	}
+	wanted := make(map[string]int, len(missing))
+	for _, hash := range missing {
+		wanted[hash] = lengths[hash]
+	}
+	if err = s.receiveChunks(c, wanted); err != nil {
+		return err
+	}
+
+	for i := range manifests {
+		if err = s.putManifest(&manifests[i]); err != nil {
+			return err
+		}
+	}
+	return c.send(&message{Type: doneMessage})
+}
+
+// chunkLengths returns length of every chunk referenced by manifests. Manifest size must match its chunks
+// and all references of the same chunk must agree on its length
+func chunkLengths(manifests []Manifest) (map[string]int, error) {
+	lengths := make(map[string]int)
+	for _, manifest := range manifests {
+		size := int64(0)
+		for _, ref := range manifest.Chunks {
+			if ref.Length < 0 {
+				return nil, fmt.Errorf("manifest of %s has chunk %s of %d bytes", manifest.Name, ref.Hash, ref.Length)
+			}
+			if length, ok := lengths[ref.Hash]; ok && length != ref.Length {
+				return nil, fmt.Errorf("manifest of %s has chunk %s of %d bytes, other reference has %d bytes",
+					manifest.Name, ref.Hash, ref.Length, length)
+			}
+			lengths[ref.Hash] = ref.Length
+			size += int64(ref.Length)
+		}
+		if size != manifest.Size {
+			return nil, fmt.Errorf("manifest of %s has size %d, its chunks have %d bytes", manifest.Name, manifest.Size, size)
+		}
+	}
+
+	return lengths, nil
+}
+
+// missingChunks returns hashes of chunks referenced by manifests which are not in the store, without duplicates
+func (s *Store) missingChunks(manifests []Manifest) ([]string, error) {
+	missing := make([]string, 0)
+	seen := make(map[string]struct{})
+	for _, manifest := range manifests {
+		for _, ref := range manifest.Chunks {
+			if _, ok := seen[ref.Hash]; ok {
+				continue
+			}
+			seen[ref.Hash] = struct{}{}
+
+			has, err := s.Has(ref.Hash)
+			if err != nil {
+				return nil, err
+			}
+			if !has {
+				missing = append(missing, ref.Hash)
+			}
+		}
+	}
+
+	return missing, nil
+}
+
+// sendChunks sends chunks in messages of limited size, followed by done message
+func (s *Store) sendChunks(c *conn, hashes []string) error {
+	batch := &message{Type: chunksMessage}
+	batchSize := 0
+	for _, hash := range hashes {
+		data, err := s.chunk(hash)
+		if err != nil {
+			return err
+		}
+		batch.Chunks = append(batch.Chunks, chunkData{Hash: hash, Data: data})
+		batchSize += len(data)
+		if batchSize >= maxChunksMessageSize {
+			if err = c.send(batch); err != nil {
+				return err
+			}
+			batch = &message{Type: chunksMessage}
+			batchSize = 0
+		}
+	}
+	if len(batch.Chunks) > 0 {
+		if err := c.send(batch); err != nil {
+			return err
+		}
+	}
+
+	return c.send(&message{Type: doneMessage})
+}
+
+// receiveChunks stores chunks until done message. Every chunk is verified against its hash and length
+// (wanted maps hash to length), each wanted chunk must be received exactly once and no other chunk is accepted
+func (s *Store) receiveChunks(c *conn, wanted map[string]int) error {
+	pending := make(map[string]int, len(wanted))
+	for hash, length := range wanted {
+		pending[hash] = length
+	}
+	for {
+		msg := &message{}
+		if err := c.dec.Decode(msg); err != nil {
+			return fmt.Errorf("failed to receive message: %w", err)
+		}
+		switch msg.Type {
+		case doneMessage:
+			if len(pending) > 0 {
+				return fmt.Errorf("received %d chunks, expected %d", len(wanted)-len(pending), len(wanted))
+			}
+			return nil
+		case chunksMessage:
+		case errorMessage:
+			return fmt.Errorf("remote store: %s", msg.Error)
+		default:
+			return fmt.Errorf("unexpected message type %d, expected %d", msg.Type, chunksMessage)
+		}
+
+		for _, chunk := range msg.Chunks {
+			length, ok := pending[chunk.Hash]
+			if !ok {
+				return fmt.Errorf("received chunk %s which was not requested", chunk.Hash)
+			}
+			if len(chunk.Data) != length {
+				return fmt.Errorf("received chunk %s of %d bytes, expected %d", chunk.Hash, len(chunk.Data), length)
+			}
+			if strongHash(chunk.Data) != chunk.Hash {
+				return fmt.Errorf("received chunk %s is corrupted", chunk.Hash)
+			}
+			if err := s.putChunk(chunk.Hash, chunk.Data); err != nil {
+				return err
+			}
+			delete(pending, chunk.Hash)
+		}
+	}
+}
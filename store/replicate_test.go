@@ -0,0 +1,203 @@
+package store
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplicate(t *testing.T) {
+	version1 := randomData(1, 256*1024)
+	version2 := append(append([]byte{}, version1[:128*1024]...), randomData(2, 128*1024)...)
+
+	testCases := map[string]struct {
+		localFiles  map[string][]byte
+		remoteFiles map[string][]byte
+		push        []string
+		pull        []string
+		// maxTransferred is upper bound of chunk bytes stored by the receiving side
+		maxTransferred int
+	}{
+		"should push file to empty store": {
+			localFiles:     map[string][]byte{"v1": version1},
+			remoteFiles:    map[string][]byte{},
+			push:           []string{"v1"},
+			maxTransferred: len(version1),
+		},
+		"should push only chunks missing in remote store": {
+			localFiles:     map[string][]byte{"v1": version1, "v2": version2},
+			remoteFiles:    map[string][]byte{"v1": version1},
+			push:           []string{"v2"},
+			maxTransferred: len(version2)/2 + 32*1024,
+		},
+		"should pull only chunks missing in local store": {
+			localFiles:     map[string][]byte{"v1": version1},
+			remoteFiles:    map[string][]byte{"v1": version1, "v2": version2},
+			pull:           []string{"v2"},
+			maxTransferred: len(version2)/2 + 32*1024,
+		},
+		"should not transfer any chunk if all are present": {
+			localFiles:     map[string][]byte{"v1": version1},
+			remoteFiles:    map[string][]byte{"v1-copy": version1},
+			push:           []string{"v1"},
+			pull:           []string{"v1-copy"},
+			maxTransferred: 0,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// given
+			local := storeWithFiles(t, tc.localFiles)
+			remote := storeWithFiles(t, tc.remoteFiles)
+			localBefore, remoteBefore := storedBytes(t, local), storedBytes(t, remote)
+
+			// when
+			if len(tc.push) > 0 {
+				client := serve(t, remote)
+				require.NoError(t, local.Push(client, tc.push...))
+			}
+			if len(tc.pull) > 0 {
+				client := serve(t, remote)
+				require.NoError(t, local.Pull(client, tc.pull...))
+			}
+
+			// then
+			transferred := storedBytes(t, local) - localBefore + storedBytes(t, remote) - remoteBefore
+			assert.LessOrEqual(t, transferred, tc.maxTransferred)
+			for _, name := range tc.push {
+				assertFiles(t, remote, map[string][]byte{name: tc.localFiles[name]})
+			}
+			for _, name := range tc.pull {
+				assertFiles(t, local, map[string][]byte{name: tc.remoteFiles[name]})
+			}
+		})
+	}
+
+	t.Run("should report error of remote store", func(t *testing.T) {
+		// given
+		local := storeWithFiles(t, map[string][]byte{})
+		remote := storeWithFiles(t, map[string][]byte{})
+		client, server := net.Pipe()
+		defer client.Close()
+		go func() {
+			_ = remote.Serve(server)
+			server.Close()
+		}()
+
+		// when
+		err := local.Pull(client, "unknown")
+
+		// then
+		assert.ErrorContains(t, err, "remote store: file unknown: not found")
+	})
+
+	t.Run("should reject invalid response of remote store", func(t *testing.T) {
+		remote := storeWithFiles(t, map[string][]byte{"v1": version1})
+		manifest, err := remote.Manifest("v1")
+		require.NoError(t, err)
+		unrequested := []byte("unrequested chunk")
+		renamed := *manifest
+		renamed.Name = "local"
+		resized := *manifest
+		resized.Size++
+		shortened := *manifest
+		shortened.Chunks = append([]ChunkRef{}, manifest.Chunks...)
+		shortened.Chunks[0].Length--
+		shortened.Size--
+
+		testCases := map[string]struct {
+			manifest Manifest
+			extra    []chunkData
+			err      string
+		}{
+			"should not store chunk which was not requested": {
+				manifest: *manifest,
+				extra:    []chunkData{{Hash: strongHash(unrequested), Data: unrequested}},
+				err:      "which was not requested",
+			},
+			"should not store manifest which was not requested": {
+				manifest: renamed,
+				err:      "received manifest of local which was not requested",
+			},
+			"should not store manifest with size different from its chunks": {
+				manifest: resized,
+				err:      "its chunks have",
+			},
+			"should not store chunk of different length than referenced": {
+				manifest: shortened,
+				err:      "expected",
+			},
+		}
+
+		for name, tc := range testCases {
+			t.Run(name, func(t *testing.T) {
+				// given
+				local := storeWithFiles(t, map[string][]byte{"local": []byte("local")})
+				client := servePull(t, remote, tc.manifest, tc.extra)
+
+				// when
+				err := local.Pull(client, "v1")
+
+				// then
+				assert.ErrorContains(t, err, tc.err)
+				assertFiles(t, local, map[string][]byte{"local": []byte("local")})
+				for _, chunk := range tc.extra {
+					has, err := local.Has(chunk.Hash)
+					require.NoError(t, err)
+					assert.False(t, has)
+				}
+			})
+		}
+	})
+}
+
+// servePull answers single pull request with manifest, and then wanted chunks of the remote store followed by
+// extra chunks, regardless of what was requested
+func servePull(t *testing.T, remote *Store, manifest Manifest, extra []chunkData) net.Conn {
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+	})
+	go func() {
+		defer server.Close()
+		c := newConn(server)
+		if _, err := c.receive(pullRequest); err != nil {
+			return
+		}
+		if err := c.send(&message{Type: manifestsMessage, Manifests: []Manifest{manifest}}); err != nil {
+			return
+		}
+		want, err := c.receive(wantMessage)
+		if err != nil {
+			return
+		}
+		batch := &message{Type: chunksMessage, Chunks: extra}
+		for _, hash := range want.Hashes {
+			data, _ := remote.chunk(hash)
+			batch.Chunks = append(batch.Chunks, chunkData{Hash: hash, Data: data})
+		}
+		if err = c.send(batch); err != nil {
+			return
+		}
+		_ = c.send(&message{Type: doneMessage})
+	}()
+	return client
+}
+
+// serve starts serving single session of the store and returns client side of the connection
+func serve(t *testing.T, store *Store) net.Conn {
+	client, server := net.Pipe()
+	served := make(chan error, 1)
+	go func() {
+		served <- store.Serve(server)
+		server.Close()
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		assert.NoError(t, <-served)
+	})
+	return client
+}
@@ -0,0 +1,365 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	filediff "file-diff"
+)
+
+const (
+	chunksDir    = "chunks"
+	manifestsDir = "manifests"
+	manifestExt  = ".json"
+	lockFileName = "lock"
+	tempPrefix   = ".tmp-"
+	// shardLength number of hash characters used as chunk directory name
+	shardLength = 2
+)
+
+// ErrNotFound is returned when requested file or chunk is not in the store
+var ErrNotFound = errors.New("not found")
+
+// ErrInvalidHash is returned when chunk hash is not a hex encoded SHA-256 (64 lowercase hex characters)
+var ErrInvalidHash = errors.New("invalid chunk hash")
+
+// Store is a content addressable storage of file chunks. Chunks are stored once, under their strong hash,
+// in directories sharded by hash prefix (loose chunks) or appended to pack files (see Pack).
+// Files are recorded as manifests - ordered lists of chunks, so many versions of the same file cost only
+// their unique chunks. Store is safe for concurrent use, also by many processes (on Unix systems)
+type Store struct {
+	root      string
+	chunkSize uint64
+	// mu synchronizes store within the process, lock file synchronizes processes
+	mu sync.RWMutex
+
+	// indexMu guards index of packed chunks, which is loaded for packs generation
+	indexMu    sync.RWMutex
+	packs      map[string]packLocation
+	generation int
+}
+
+// Manifest describes stored file as ordered list of its chunks
+type Manifest struct {
+	// Name under which file was stored
+	Name string
+	// Size of the whole file
+	Size int64
+	// Chunks which concatenated in order produce the file content
+	Chunks []ChunkRef
+}
+
+// ChunkRef points to a chunk stored in the store
+type ChunkRef struct {
+	// Hash strong hash of the chunk
+	Hash string
+	// Length define how long chunk is
+	Length int
+}
+
+// Signature returns chunks of the file with their offsets, without data. It can be compared with
+// filediff.DiffChunks or filediff.ChangedRanges without reading file content
+func (m *Manifest) Signature() []filediff.Chunk {
+	chunks := make([]filediff.Chunk, 0, len(m.Chunks))
+	offset := 0
+	for _, ref := range m.Chunks {
+		chunks = append(chunks, filediff.Chunk{Offset: offset, Length: ref.Length, Hash: ref.Hash})
+		offset += ref.Length
+	}
+
+	return chunks
+}
+
+// Open opens store in root directory, creating it if it doesn't exist. Files are chunked
+// with chunkSize which needs to be integer equal to power of two
+func Open(root string, chunkSize uint64) (*Store, error) {
+	if _, err := filediff.Split(nil, chunkSize); err != nil {
+		return nil, err
+	}
+	for _, dir := range []string{chunksDir, manifestsDir, packsDir} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create store directory: %w", err)
+		}
+	}
+
+	store := &Store{root: root, chunkSize: chunkSize}
+	if err := store.refreshPacks(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// Put stores file content read from r under name. Only chunks which are not in the store yet are written.
+// File with the same name is replaced
+func (s *Store) Put(name string, r io.Reader) (*Manifest, error) {
+	var manifest *Manifest
+	err := s.withLock(false, func() error {
+		var err error
+		manifest, err = s.put(name, r)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+func (s *Store) put(name string, r io.Reader) (*Manifest, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read data of %s: %w", name, err)
+	}
+	chunks, err := filediff.Split(data, s.chunkSize)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &Manifest{Name: name, Size: int64(len(data)), Chunks: make([]ChunkRef, 0, len(chunks))}
+	for _, chunk := range chunks {
+		if err = s.putChunk(chunk.Hash, chunk.Data); err != nil {
+			return nil, err
+		}
+		manifest.Chunks = append(manifest.Chunks, ChunkRef{Hash: chunk.Hash, Length: chunk.Length})
+	}
+	if err = s.putManifest(manifest); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// Get writes content of the file stored under name to w. Every chunk is verified against its hash
+func (s *Store) Get(name string, w io.Writer) error {
+	return s.withLock(false, func() error {
+		return s.get(name, w)
+	})
+}
+
+func (s *Store) get(name string, w io.Writer) error {
+	manifest, err := s.Manifest(name)
+	if err != nil {
+		return err
+	}
+
+	for _, ref := range manifest.Chunks {
+		data, err := s.chunk(ref.Hash)
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(data); err != nil {
+			return fmt.Errorf("failed to write data: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Delete removes file stored under name. Its chunks are freed by GC, once no other file references them
+func (s *Store) Delete(name string) error {
+	return s.withLock(false, func() error {
+		err := os.Remove(s.manifestPath(name))
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("file %s: %w", name, ErrNotFound)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to remove manifest of %s: %w", name, err)
+		}
+		return nil
+	})
+}
+
+// Has reports whether chunk with given strong hash is in the store
+func (s *Store) Has(hash string) (bool, error) {
+	if err := validateHash(hash); err != nil {
+		return false, err
+	}
+	if _, ok := s.packLocation(hash); ok {
+		return true, nil
+	}
+	_, err := os.Stat(s.chunkPath(hash))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to stat chunk %s: %w", hash, err)
+	}
+
+	return true, nil
+}
+
+// Manifest returns manifest of the file stored under name
+func (s *Store) Manifest(name string) (*Manifest, error) {
+	data, err := os.ReadFile(s.manifestPath(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("file %s: %w", name, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest of %s: %w", name, err)
+	}
+
+	manifest := &Manifest{}
+	if err = json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest of %s: %w", name, err)
+	}
+
+	return manifest, nil
+}
+
+// List returns names of all stored files in lexical order
+func (s *Store) List() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(s.root, manifestsDir))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list manifests: %w", err)
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), manifestExt) {
+			continue
+		}
+		name, err := url.PathUnescape(strings.TrimSuffix(entry.Name(), manifestExt))
+		if err != nil {
+			return nil, fmt.Errorf("invalid manifest file name %s: %w", entry.Name(), err)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// withLock calls fn holding shared (writers and readers) or exclusive (GC) lock of the store
+func (s *Store) withLock(exclusive bool, fn func() error) (err error) {
+	if exclusive {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	} else {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+	}
+
+	unlockFile, err := lockFile(filepath.Join(s.root, lockFileName), exclusive)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if unlockErr := unlockFile(); unlockErr != nil && err == nil {
+			err = fmt.Errorf("failed to unlock store: %w", unlockErr)
+		}
+	}()
+	if err = s.refreshPacks(); err != nil {
+		return err
+	}
+
+	return fn()
+}
+
+func (s *Store) chunk(hash string) ([]byte, error) {
+	if err := validateHash(hash); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(s.chunkPath(hash))
+	if errors.Is(err, os.ErrNotExist) {
+		location, ok := s.packLocation(hash)
+		if !ok {
+			return nil, fmt.Errorf("chunk %s: %w", hash, ErrNotFound)
+		}
+		data, err = s.readPacked(hash, location)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunk %s: %w", hash, err)
+	}
+	if strongHash(data) != hash {
+		return nil, fmt.Errorf("chunk %s is corrupted", hash)
+	}
+
+	return data, nil
+}
+
+func (s *Store) putChunk(hash string, data []byte) error {
+	exists, err := s.Has(hash)
+	if err != nil || exists {
+		return err
+	}
+	path := s.chunkPath(hash)
+	if err = os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create chunk directory: %w", err)
+	}
+
+	return writeFileAtomic(path, data)
+}
+
+func (s *Store) putManifest(manifest *Manifest) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest of %s: %w", manifest.Name, err)
+	}
+
+	return writeFileAtomic(s.manifestPath(manifest.Name), data)
+}
+
+// chunkPath expects hash which passed validateHash, so it can't point outside of chunks directory
+func (s *Store) chunkPath(hash string) string {
+	return filepath.Join(s.root, chunksDir, hash[:shardLength], hash)
+}
+
+func (s *Store) manifestPath(name string) string {
+	return filepath.Join(s.root, manifestsDir, url.PathEscape(name)+manifestExt)
+}
+
+// writeFileAtomic writes data to temporary file and renames it, so readers never see partially written file
+func writeFileAtomic(path string, data []byte) (err error) {
+	file, err := os.CreateTemp(filepath.Dir(path), tempPrefix)
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(file.Name())
+		}
+	}()
+
+	if _, err = file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write file on disk: %w", err)
+	}
+	if err = file.Close(); err != nil {
+		return fmt.Errorf("failed to close file: %w", err)
+	}
+	if err = os.Rename(file.Name(), path); err != nil {
+		return fmt.Errorf("failed to rename file: %w", err)
+	}
+
+	return nil
+}
+
+// validateHash checks hash format before it's used as a file name. Hashes come also from manifests
+// and peers, so anything else could point outside of the store
+func validateHash(hash string) error {
+	if len(hash) != hex.EncodedLen(sha256.Size) {
+		return fmt.Errorf("%w: %q", ErrInvalidHash, hash)
+	}
+	for _, c := range hash {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return fmt.Errorf("%w: %q", ErrInvalidHash, hash)
+		}
+	}
+	return nil
+}
+
+func strongHash(data []byte) string {
+	strongHash := sha256.Sum256(data)
+	return hex.EncodeToString(strongHash[:])
+}
@@ -0,0 +1,146 @@
+package store
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+	version1 := randomData(1, 256*1024)
+	// version2 differs from version1 only in the middle
+	version2 := append(append(append([]byte{}, version1[:128*1024]...), randomData(2, 100)...), version1[128*1024:]...)
+
+	testCases := map[string]struct {
+		files map[string][]byte
+		// maxStoredBytes is upper bound of bytes stored in chunks
+		maxStoredBytes int
+	}{
+		"should store single file": {
+			files:          map[string][]byte{"artifact-1": version1},
+			maxStoredBytes: len(version1),
+		},
+		"should store identical files once": {
+			files:          map[string][]byte{"artifact-1": version1, "copy": version1},
+			maxStoredBytes: len(version1),
+		},
+		"should store only unique chunks of next version": {
+			files:          map[string][]byte{"artifact-1": version1, "artifact-2": version2},
+			maxStoredBytes: len(version1) + 32*1024,
+		},
+		"should store empty file": {
+			files:          map[string][]byte{"empty": {}},
+			maxStoredBytes: 0,
+		},
+		"should store files with path like names": {
+			files:          map[string][]byte{"releases/1.0/artifact": version1, "../outside": version2},
+			maxStoredBytes: len(version1) + 32*1024,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// given
+			store, err := Open(t.TempDir(), uint64(4096))
+			require.NoError(t, err)
+
+			// when
+			names := make([]string, 0)
+			for name, content := range tc.files {
+				manifest, err := store.Put(name, createTempTestFile(t, content))
+				require.NoError(t, err)
+				assert.Equal(t, int64(len(content)), manifest.Size)
+				names = append(names, name)
+			}
+
+			// then
+			for name, content := range tc.files {
+				buffer := &bytes.Buffer{}
+				require.NoError(t, store.Get(name, buffer))
+				assert.Equal(t, string(content), buffer.String())
+
+				manifest, err := store.Manifest(name)
+				require.NoError(t, err)
+				for _, ref := range manifest.Chunks {
+					has, err := store.Has(ref.Hash)
+					require.NoError(t, err)
+					assert.True(t, has)
+				}
+			}
+			listed, err := store.List()
+			require.NoError(t, err)
+			assert.ElementsMatch(t, names, listed)
+			assert.LessOrEqual(t, storedBytes(t, store), tc.maxStoredBytes)
+		})
+	}
+
+	t.Run("should return not found error for unknown file", func(t *testing.T) {
+		store, err := Open(t.TempDir(), uint64(4096))
+		require.NoError(t, err)
+
+		err = store.Get("unknown", &bytes.Buffer{})
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("should not report unknown chunk", func(t *testing.T) {
+		store, err := Open(t.TempDir(), uint64(4096))
+		require.NoError(t, err)
+
+		has, err := store.Has(strings.Repeat("0123456789abcdef", 4))
+		assert.NoError(t, err)
+		assert.False(t, has)
+	})
+
+	t.Run("should reject invalid chunk hash", func(t *testing.T) {
+		// given
+		store, err := Open(t.TempDir(), uint64(4096))
+		require.NoError(t, err)
+
+		for _, hash := range []string{"", "../../../outside", "0123456789abcdef", strings.Repeat("0123456789ABCDEF", 4), strings.Repeat("0123456789abcdeg", 4)} {
+			// when
+			has, err := store.Has(hash)
+
+			// then
+			assert.ErrorIs(t, err, ErrInvalidHash, hash)
+			assert.False(t, has)
+		}
+	})
+
+	t.Run("should not open store if chunk is not power of 2", func(t *testing.T) {
+		_, err := Open(t.TempDir(), uint64(9))
+		assert.ErrorContains(t, err, "chunkSize parameter must be a power of two")
+	})
+}
+
+func randomData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func createTempTestFile(t *testing.T, content []byte) *os.File {
+	path := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(path, content, 0o644))
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { file.Close() })
+	return file
+}
+
+func storedBytes(t *testing.T, store *Store) int {
+	size := 0
+	err := filepath.Walk(filepath.Join(store.root, chunksDir), func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += int(info.Size())
+		}
+		return err
+	})
+	require.NoError(t, err)
+	return size
+}
@@ -0,0 +1,228 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	filediff "file-diff"
+)
+
+const (
+	// DefaultBatchSize is a default number of chunk hashes sent in a single HAVE message
+	DefaultBatchSize = 1024
+	// DefaultWindow is a default number of HAVE messages sent without waiting for response
+	DefaultWindow = 4
+)
+
+// UploadReport summarizes upload
+type UploadReport struct {
+	// Manifest of the file assembled by the server
+	Manifest *Manifest
+	// Uploaded number of chunks which were missing on the server and had to be sent
+	Uploaded int
+	// UploadedBytes size of uploaded chunks
+	UploadedBytes int64
+}
+
+type uploadOptions struct {
+	batchSize int
+	window    int
+}
+
+// UploadOption configures Upload
+type UploadOption func(*uploadOptions)
+
+// WithBatchSize sets number of chunk hashes sent in a single HAVE message. Default is DefaultBatchSize
+func WithBatchSize(size int) UploadOption {
+	return func(o *uploadOptions) {
+		o.batchSize = size
+	}
+}
+
+// WithWindow sets number of HAVE messages sent before waiting for the server response, so round trips
+// are pipelined. Default is DefaultWindow
+func WithWindow(window int) UploadOption {
+	return func(o *uploadOptions) {
+		o.window = window
+	}
+}
+
+// Upload sends file to the store served with Serve on the other side of rw, and stores it under name.
+// File is chunked with chunkSize (integer equal to power of two) and hashes of chunks are offered in
+// batches (HAVE). Server answers with the subset it lacks (WANT) and only those chunks are uploaded.
+// Server then assembles the file from its chunk store. rw can't be reused for another session
+func Upload(rw io.ReadWriter, name string, file *os.File, chunkSize uint64, opts ...UploadOption) (*UploadReport, error) {
+	options := uploadOptions{batchSize: DefaultBatchSize, window: DefaultWindow}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.batchSize < 1 || options.window < 1 {
+		return nil, errors.New("batch size and window must be positive")
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read data from file %s: %w", file.Name(), err)
+	}
+	chunks, err := filediff.Split(data, chunkSize)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &Manifest{Name: name, Size: int64(len(data)), Chunks: make([]ChunkRef, 0, len(chunks))}
+	uniqueChunks := make(map[string][]byte, len(chunks))
+	hashes := make([]string, 0, len(chunks))
+	for _, chunk := range chunks {
+		manifest.Chunks = append(manifest.Chunks, ChunkRef{Hash: chunk.Hash, Length: chunk.Length})
+		if _, ok := uniqueChunks[chunk.Hash]; !ok {
+			uniqueChunks[chunk.Hash] = chunk.Data
+			hashes = append(hashes, chunk.Hash)
+		}
+	}
+
+	c := newConn(rw)
+	if err = c.send(&message{Type: uploadRequest, Names: []string{name}}); err != nil {
+		return nil, err
+	}
+
+	// responses are read by separate goroutine, so the server is never blocked on writing
+	// while this side writes pipelined requests. Buffer fits all responses for the window
+	responses := make(chan *message, options.window+1)
+	go func() {
+		defer close(responses)
+		for {
+			msg := &message{}
+			if err := c.dec.Decode(msg); err != nil {
+				return
+			}
+			responses <- msg
+			if msg.Type != wantMessage {
+				return
+			}
+		}
+	}()
+	nextResponse := func(expected messageType) (*message, error) {
+		msg, ok := <-responses
+		if !ok {
+			return nil, errors.New("failed to receive message: connection closed")
+		}
+		if msg.Type == errorMessage {
+			return nil, fmt.Errorf("remote store: %s", msg.Error)
+		}
+		if msg.Type != expected {
+			return nil, fmt.Errorf("unexpected message type %d, expected %d", msg.Type, expected)
+		}
+		return msg, nil
+	}
+
+	report := &UploadReport{Manifest: manifest}
+	outstanding := 0
+	for len(hashes) > 0 || outstanding > 0 {
+		if len(hashes) > 0 && outstanding < options.window {
+			batch := hashes
+			if len(batch) > options.batchSize {
+				batch = batch[:options.batchSize]
+			}
+			hashes = hashes[len(batch):]
+			if err = c.send(&message{Type: haveMessage, Hashes: batch}); err != nil {
+				return nil, err
+			}
+			outstanding++
+			continue
+		}
+
+		want, err := nextResponse(wantMessage)
+		if err != nil {
+			return nil, err
+		}
+		outstanding--
+		if len(want.Hashes) == 0 {
+			continue
+		}
+		msg := &message{Type: chunksMessage, Chunks: make([]chunkData, 0, len(want.Hashes))}
+		for _, hash := range want.Hashes {
+			data, ok := uniqueChunks[hash]
+			if !ok {
+				return nil, fmt.Errorf("server asked for unknown chunk %s", hash)
+			}
+			msg.Chunks = append(msg.Chunks, chunkData{Hash: hash, Data: data})
+			report.Uploaded++
+			report.UploadedBytes += int64(len(data))
+		}
+		if err = c.send(msg); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = c.send(&message{Type: manifestsMessage, Manifests: []Manifest{*manifest}}); err != nil {
+		return nil, err
+	}
+	if _, err = nextResponse(doneMessage); err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// serveUpload answers HAVE messages with chunks missing in the store, stores uploaded chunks and finally
+// stores the file manifest. Store must be locked by the caller
+func (s *Store) serveUpload(c *conn, name string) error {
+	requested := make(map[string]struct{})
+	for {
+		msg := &message{}
+		if err := c.dec.Decode(msg); err != nil {
+			return fmt.Errorf("failed to receive message: %w", err)
+		}
+
+		switch msg.Type {
+		case haveMessage:
+			want := make([]string, 0)
+			for _, hash := range msg.Hashes {
+				if _, ok := requested[hash]; ok {
+					continue
+				}
+				has, err := s.Has(hash)
+				if err != nil {
+					return err
+				}
+				if !has {
+					requested[hash] = struct{}{}
+					want = append(want, hash)
+				}
+			}
+			if err := c.send(&message{Type: wantMessage, Hashes: want}); err != nil {
+				return err
+			}
+		case chunksMessage:
+			for _, chunk := range msg.Chunks {
+				if _, ok := requested[chunk.Hash]; !ok {
+					return fmt.Errorf("received chunk %s which was not requested", chunk.Hash)
+				}
+				if strongHash(chunk.Data) != chunk.Hash {
+					return fmt.Errorf("received chunk %s is corrupted", chunk.Hash)
+				}
+				if err := s.putChunk(chunk.Hash, chunk.Data); err != nil {
+					return err
+				}
+			}
+		case manifestsMessage:
+			if len(msg.Manifests) != 1 || msg.Manifests[0].Name != name {
+				return fmt.Errorf("expected manifest of %s", name)
+			}
+			missing, err := s.missingChunks(msg.Manifests)
+			if err != nil {
+				return err
+			}
+			if len(missing) > 0 {
+				return fmt.Errorf("file %s can't be assembled, %d chunks are missing", name, len(missing))
+			}
+			if err = s.putManifest(&msg.Manifests[0]); err != nil {
+				return err
+			}
+			return c.send(&message{Type: doneMessage})
+		default:
+			return fmt.Errorf("unexpected message type %d", msg.Type)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package store
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpload(t *testing.T) {
+	version1 := randomData(1, 256*1024)
+	version2 := append(append([]byte{}, version1[:128*1024]...), randomData(2, 128*1024)...)
+	repeated := append(append([]byte{}, version1...), version1...)
+
+	testCases := map[string]struct {
+		serverFiles map[string][]byte
+		upload      []byte
+		opts        []UploadOption
+		// maxUploaded is upper bound of uploaded bytes
+		maxUploaded int64
+	}{
+		"should upload whole file to empty store": {
+			serverFiles: map[string][]byte{},
+			upload:      version1,
+			maxUploaded: int64(len(version1)),
+		},
+		"should upload only chunks which server lacks": {
+			serverFiles: map[string][]byte{"other-file": version1},
+			upload:      version2,
+			maxUploaded: int64(len(version2)/2 + 32*1024),
+		},
+		"should not upload anything if server has all chunks": {
+			serverFiles: map[string][]byte{"other-file": version1},
+			upload:      version1,
+			maxUploaded: 0,
+		},
+		"should upload repeated chunks once": {
+			serverFiles: map[string][]byte{},
+			upload:      repeated,
+			maxUploaded: int64(len(version1) + 32*1024),
+		},
+		"should upload in many small pipelined batches": {
+			serverFiles: map[string][]byte{"other-file": version1},
+			upload:      version2,
+			opts:        []UploadOption{WithBatchSize(3), WithWindow(2)},
+			maxUploaded: int64(len(version2)/2 + 32*1024),
+		},
+		"should upload without pipelining": {
+			serverFiles: map[string][]byte{},
+			upload:      version2,
+			opts:        []UploadOption{WithBatchSize(5), WithWindow(1)},
+			maxUploaded: int64(len(version2)),
+		},
+		"should upload empty file": {
+			serverFiles: map[string][]byte{},
+			upload:      []byte{},
+			maxUploaded: 0,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// given
+			server := storeWithFiles(t, tc.serverFiles)
+			client := serve(t, server)
+
+			// when
+			report, err := Upload(client, "uploaded", createTempTestFile(t, tc.upload), server.chunkSize, tc.opts...)
+
+			// then
+			require.NoError(t, err)
+			assert.LessOrEqual(t, report.UploadedBytes, tc.maxUploaded)
+			assert.Equal(t, int64(len(tc.upload)), report.Manifest.Size)
+			// compared as strings, empty file is read as nil bytes
+			buffer := &bytes.Buffer{}
+			require.NoError(t, server.Get("uploaded", buffer))
+			assert.Equal(t, string(tc.upload), buffer.String())
+		})
+	}
+
+	t.Run("should not upload with invalid batch size", func(t *testing.T) {
+		_, err := Upload(nil, "uploaded", nil, uint64(4096), WithBatchSize(0))
+		assert.ErrorContains(t, err, "batch size and window must be positive")
+	})
+}
@@ -0,0 +1,505 @@
+package filediff
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// TreeDelta represents the changes made to the original directory tree
+type TreeDelta struct {
+	// Files describes every entry (regular file, directory or symbolic link) of the updated tree, ordered by path
+	Files []FileDelta
+	// Removed paths of original entries which are not present in the updated tree
+	Removed []string
+}
+
+// FileDelta describes how to build a single entry of the updated tree
+type FileDelta struct {
+	// Path of the entry relative to the updated tree root
+	Path string
+	// RenamedFrom path of the original file which was detected as predecessor of renamed or moved file.
+	// Empty if the file was not renamed
+	RenamedFrom string
+	// Unchanged is set when the original entry with the same path (or RenamedFrom path) has identical content.
+	// Segments are empty in such case
+	Unchanged bool
+	// Segments which concatenated in order produce the file content. Empty for directories and symbolic links
+	Segments []Segment
+	// Metadata of the updated entry
+	Metadata Metadata
+	// MetadataChanged is set when metadata differs from the original entry. Together with Unchanged it describes
+	// metadata only change
+	MetadataChanged bool
+}
+
+// Segment is a portion of an updated file. It's either copied from any of the original files
+// (addressed by file, offset and length) or carries new data
+type Segment struct {
+	// Source path of the original file relative to the original tree root. Empty for new data
+	Source string
+	// Offset point to starting segment position in the source file
+	Offset int
+	// Length define how long segment is
+	Length int
+	// Hash strong hash of the segment data. Empty for merged copies of few chunks
+	Hash string
+	// Data new data which needs to be sent. Empty for segments copied from original files
+	Data []byte
+}
+
+// treeIndex maps chunk strong hash to the first place it can be found in the original tree
+type treeIndex map[string]Segment
+
+// chunkSet maps chunk strong hash to its length
+type chunkSet map[string]int
+
+type treeOptions struct {
+	renameThreshold float64
+	renameMinSize   int
+}
+
+// TreeOption configures TreeDiff
+type TreeOption func(*treeOptions)
+
+// WithRenameThreshold sets minimal ratio (0-1] of bytes in shared chunks for which
+// removed and added files are reported as rename. Threshold above 1 disables rename detection.
+// Default is 0.5
+func WithRenameThreshold(threshold float64) TreeOption {
+	return func(o *treeOptions) {
+		o.renameThreshold = threshold
+	}
+}
+
+// WithRenameMinSize sets minimal size in bytes of files considered in rename detection.
+// Small files share chunks by accident too easily. Default is 0 (all files are considered)
+func WithRenameMinSize(size int) TreeOption {
+	return func(o *treeOptions) {
+		o.renameMinSize = size
+	}
+}
+
+// TreeDiff compares two directory trees and returns TreeDelta which can be used to rebuild updated
+// tree from the original one. All original files are indexed together, so chunk of updated file can be
+// copied from any original file - split, renamed or merged files don't need to be sent again.
+// Files which exist only in updated tree are scored against files which exist only in original tree
+// by ratio of shared chunks and pairs above threshold are reported as renames (see WithRenameThreshold).
+// It requires chunkSize which needs to be integer equal to power of two
+func TreeDiff(original, updated string, chunkSize uint64, opts ...TreeOption) (*TreeDelta, error) {
+	if !isPowerOfTwo(chunkSize) {
+		return nil, errors.New("chunkSize parameter must be a power of two")
+	}
+	options := treeOptions{renameThreshold: 0.5}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	originalFiles, originalMetadata, err := listEntries(original)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list original tree: %w", err)
+	}
+	updatedFiles, updatedMetadata, err := listEntries(updated)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list updated tree: %w", err)
+	}
+
+	index := make(treeIndex)
+	originalHashes := make(map[string]string, len(originalFiles))
+	// original files which are missing in updated tree - candidates for rename
+	removedIndexes := make(map[string]treeIndex)
+	removedChunks := make(map[string]chunkSet)
+	for _, path := range originalFiles {
+		if !originalMetadata[path].Mode.IsRegular() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(original, filepath.FromSlash(path)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file: %w", err)
+		}
+		chunks := splitChunks(data, chunkSize)
+		originalHashes[path] = index.add(path, data, chunks)
+		if _, ok := updatedMetadata[path]; !ok && len(data) >= options.renameMinSize {
+			removedIndexes[path] = make(treeIndex)
+			removedIndexes[path].add(path, data, chunks)
+			removedChunks[path] = newChunkSet(chunks)
+		}
+	}
+
+	addedChunks := make(map[string]chunkSet)
+	for _, path := range updatedFiles {
+		if _, ok := originalMetadata[path]; ok || len(removedChunks) == 0 || !updatedMetadata[path].Mode.IsRegular() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(updated, filepath.FromSlash(path)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file: %w", err)
+		}
+		if len(data) >= options.renameMinSize {
+			addedChunks[path] = newChunkSet(splitChunks(data, chunkSize))
+		}
+	}
+	renames := detectRenames(removedChunks, addedChunks, options.renameThreshold)
+
+	delta := &TreeDelta{
+		Files:   make([]FileDelta, 0, len(updatedFiles)),
+		Removed: make([]string, 0),
+	}
+	renamedFrom := make(map[string]struct{}, len(renames))
+	for _, path := range updatedFiles {
+		fileDelta := FileDelta{Path: path, RenamedFrom: renames[path], Metadata: updatedMetadata[path]}
+		predecessor := path
+		if fileDelta.RenamedFrom != "" {
+			predecessor = fileDelta.RenamedFrom
+			renamedFrom[predecessor] = struct{}{}
+		}
+		predecessorMetadata, ok := originalMetadata[predecessor]
+		fileDelta.MetadataChanged = !ok || !predecessorMetadata.Equal(fileDelta.Metadata)
+
+		if !fileDelta.Metadata.Mode.IsRegular() {
+			// content of directories and symbolic links is fully described by metadata
+			fileDelta.Unchanged = ok && predecessorMetadata.Mode.Type() == fileDelta.Metadata.Mode.Type() &&
+				predecessorMetadata.Symlink == fileDelta.Metadata.Symlink
+			delta.Files = append(delta.Files, fileDelta)
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(updated, filepath.FromSlash(path)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file: %w", err)
+		}
+		if originalHash, ok := originalHashes[predecessor]; ok && originalHash == newChunk(data, 0).Hash {
+			fileDelta.Unchanged = true
+		} else {
+			fileDelta.Segments = index.segments(splitChunks(data, chunkSize), removedIndexes[fileDelta.RenamedFrom])
+		}
+		delta.Files = append(delta.Files, fileDelta)
+	}
+
+	for _, path := range originalFiles {
+		_, updated := updatedMetadata[path]
+		_, renamed := renamedFrom[path]
+		if !updated && !renamed {
+			delta.Removed = append(delta.Removed, path)
+		}
+	}
+
+	return delta, nil
+}
+
+// detectRenames pairs added files with removed ones. Pairs are scored by ratio of bytes in shared chunks
+// to size of the bigger file and the best scored pairs, not lower than threshold, are chosen first.
+// It returns map of added file path to removed file path
+func detectRenames(removed, added map[string]chunkSet, threshold float64) map[string]string {
+	type candidate struct {
+		from, to string
+		score    float64
+	}
+	candidates := make([]candidate, 0)
+	for to, addedSet := range added {
+		for from, removedSet := range removed {
+			if score := addedSet.similarity(removedSet); score >= threshold && score > 0 {
+				candidates = append(candidates, candidate{from: from, to: to, score: score})
+			}
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].score != candidates[j].score {
+			return candidates[i].score > candidates[j].score
+		}
+		if candidates[i].to != candidates[j].to {
+			return candidates[i].to < candidates[j].to
+		}
+		return candidates[i].from < candidates[j].from
+	})
+
+	renames := make(map[string]string)
+	used := make(map[string]struct{})
+	for _, c := range candidates {
+		if _, ok := renames[c.to]; ok {
+			continue
+		}
+		if _, ok := used[c.from]; ok {
+			continue
+		}
+		renames[c.to] = c.from
+		used[c.from] = struct{}{}
+	}
+
+	return renames
+}
+
+func newChunkSet(chunks []Chunk) chunkSet {
+	set := make(chunkSet, len(chunks))
+	for _, chunk := range chunks {
+		set[chunk.Hash] = chunk.Length
+	}
+	return set
+}
+
+func (cs chunkSet) size() int {
+	size := 0
+	for _, length := range cs {
+		size += length
+	}
+	return size
+}
+
+// similarity returns ratio of bytes in chunks shared by both sets to size of the bigger set
+func (cs chunkSet) similarity(other chunkSet) float64 {
+	shared := 0
+	for hash, length := range cs {
+		if _, ok := other[hash]; ok {
+			shared += length
+		}
+	}
+	biggest := cs.size()
+	if otherSize := other.size(); otherSize > biggest {
+		biggest = otherSize
+	}
+	if biggest == 0 {
+		return 0
+	}
+
+	return float64(shared) / float64(biggest)
+}
+
+// add indexes chunks of the original file and returns strong hash of the whole file
+func (idx treeIndex) add(path string, data []byte, chunks []Chunk) string {
+	for _, chunk := range chunks {
+		if _, ok := idx[chunk.Hash]; !ok {
+			idx[chunk.Hash] = Segment{
+				Source: path,
+				Offset: chunk.Offset,
+				Length: chunk.Length,
+				Hash:   chunk.Hash,
+			}
+		}
+	}
+
+	return newChunk(data, 0).Hash
+}
+
+// segments describes chunks with segments copied from the original tree where possible.
+// Chunks of predecessor file (if known) are preferred over the same chunks found in other files.
+// Copies of adjacent chunks of the same original file are merged into one segment
+func (idx treeIndex) segments(chunks []Chunk, predecessor treeIndex) []Segment {
+	segments := make([]Segment, 0)
+	for _, chunk := range chunks {
+		segment, ok := predecessor[chunk.Hash]
+		if !ok {
+			segment, ok = idx[chunk.Hash]
+		}
+		if !ok {
+			segments = append(segments, Segment{
+				Offset: chunk.Offset,
+				Length: chunk.Length,
+				Hash:   chunk.Hash,
+				Data:   chunk.Data,
+			})
+			continue
+		}
+
+		if last := len(segments) - 1; last >= 0 && segments[last].Source == segment.Source &&
+			segments[last].Source != "" && segments[last].Offset+segments[last].Length == segment.Offset {
+			segments[last].Length += segment.Length
+			segments[last].Hash = ""
+			continue
+		}
+		segments = append(segments, segment)
+	}
+
+	return segments
+}
+
+// ErrUnsafePath is returned when path of an entry would lead out of the directory it's applied to
+var ErrUnsafePath = errors.New("unsafe path")
+
+// ApplyTree rebuilds updated tree in the target directory using files from the original tree
+// and the TreeDelta produced by TreeDiff. Metadata of every entry is restored as well
+// (ownership and extended attributes only on Linux, where they are skipped if the user isn't permitted to set them).
+// Original tree is not modified
+func ApplyTree(original, target string, delta *TreeDelta) error {
+	sources := make(map[string]*os.File)
+	defer func() {
+		for _, file := range sources {
+			file.Close()
+		}
+	}()
+	openSource := func(path string) (*os.File, error) {
+		if file, ok := sources[path]; ok {
+			return file, nil
+		}
+		sourcePath, err := JoinLocal(original, path)
+		if err != nil {
+			return nil, err
+		}
+		file, err := os.Open(sourcePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open a file: %w", err)
+		}
+		sources[path] = file
+		return file, nil
+	}
+
+	if err := os.MkdirAll(target, 0o755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	// directories metadata is restored at the end, otherwise creating their content would change it
+	directories := make([]FileDelta, 0)
+	for _, fileDelta := range delta.Files {
+		targetPath, err := JoinLocal(target, fileDelta.Path)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(targetPath), 0o755); err != nil {
+			return fmt.Errorf("failed to create directory: %w", err)
+		}
+
+		switch {
+		case fileDelta.Metadata.Mode.IsDir():
+			if err := os.Mkdir(targetPath, 0o700); err != nil && !os.IsExist(err) {
+				return fmt.Errorf("failed to create directory: %w", err)
+			}
+			directories = append(directories, fileDelta)
+			continue
+		case fileDelta.Metadata.Mode&os.ModeSymlink != 0:
+			if err := os.Symlink(fileDelta.Metadata.Symlink, targetPath); err != nil {
+				return fmt.Errorf("failed to create symlink: %w", err)
+			}
+		default:
+			segments := fileDelta.Segments
+			if fileDelta.Unchanged {
+				source := fileDelta.Path
+				if fileDelta.RenamedFrom != "" {
+					source = fileDelta.RenamedFrom
+				}
+				segments = []Segment{{Source: source, Length: -1}}
+			}
+			if err := writeSegments(targetPath, segments, openSource); err != nil {
+				return fmt.Errorf("failed to build file %s: %w", fileDelta.Path, err)
+			}
+		}
+
+		if err := RestoreMetadata(targetPath, fileDelta.Metadata); err != nil {
+			return err
+		}
+	}
+
+	for i := len(directories) - 1; i >= 0; i-- {
+		targetPath, err := JoinLocal(target, directories[i].Path)
+		if err != nil {
+			return err
+		}
+		if err = RestoreMetadata(targetPath, directories[i].Metadata); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// JoinLocal joins slash separated path from a delta or snapshot with root. It fails with ErrUnsafePath when path
+// is absolute, contains ".." elements or goes through a symbolic link which already exists under root, as any of them
+// could lead out of root
+func JoinLocal(root, path string) (string, error) {
+	local := filepath.FromSlash(path)
+	if !filepath.IsLocal(local) {
+		return "", fmt.Errorf("%w: %s", ErrUnsafePath, path)
+	}
+
+	current := root
+	for _, element := range strings.Split(filepath.Clean(local), string(filepath.Separator)) {
+		current = filepath.Join(current, element)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to read file info: %w", err)
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("%w: %s goes through symbolic link", ErrUnsafePath, path)
+		}
+	}
+
+	return filepath.Join(root, local), nil
+}
+
+// writeSegments creates file under path from segments. Segment with negative length
+// copies the whole source file
+func writeSegments(path string, segments []Segment, openSource func(string) (*os.File, error)) (err error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create a file: %w", err)
+	}
+	defer func() {
+		if closeErr := file.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("failed to close file: %w", closeErr)
+		}
+	}()
+
+	for _, segment := range segments {
+		if segment.Source == "" {
+			if _, err = file.Write(segment.Data); err != nil {
+				return fmt.Errorf("failed to write data: %w", err)
+			}
+			continue
+		}
+
+		source, err := openSource(segment.Source)
+		if err != nil {
+			return err
+		}
+		var reader io.Reader = io.NewSectionReader(source, int64(segment.Offset), int64(segment.Length))
+		if segment.Length < 0 {
+			reader = io.NewSectionReader(source, 0, 1<<62)
+		}
+		copied, err := io.Copy(file, reader)
+		if err != nil {
+			return fmt.Errorf("failed to copy data from %s: %w", segment.Source, err)
+		}
+		// section reader stops at the end of the file, so shorter source would silently truncate the segment
+		if segment.Length >= 0 && copied != int64(segment.Length) {
+			return fmt.Errorf("%w: %s has %d bytes at offset %d, segment has %d", ErrBaseMismatch, segment.Source,
+				copied, segment.Offset, segment.Length)
+		}
+	}
+
+	return nil
+}
+
+// listEntries returns slash separated paths of all entries under root, relative to root, together
+// with their metadata
+func listEntries(root string) ([]string, map[string]Metadata, error) {
+	paths := make([]string, 0)
+	metadata := make(map[string]Metadata)
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		relative, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		relative = filepath.ToSlash(relative)
+		if metadata[relative], err = ReadMetadata(path); err != nil {
+			return err
+		}
+		paths = append(paths, relative)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(paths)
+
+	return paths, metadata, nil
+}
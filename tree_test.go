@@ -0,0 +1,270 @@
+package filediff
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTreeDiff(t *testing.T) {
+	first := randomData(1, 64*1024)
+	second := randomData(2, 64*1024)
+
+	testCases := map[string]struct {
+		originalTree map[string][]byte
+		updatedTree  map[string][]byte
+		removed      []string
+		// maxNewData is upper bound of bytes which need to be sent in delta
+		maxNewData int
+	}{
+		"should not send any data for unchanged tree": {
+			originalTree: map[string][]byte{"a.bin": first, "dir/b.bin": second},
+			updatedTree:  map[string][]byte{"a.bin": first, "dir/b.bin": second},
+			removed:      []string{},
+			maxNewData:   0,
+		},
+		"should reuse chunks of renamed file": {
+			originalTree: map[string][]byte{"a.bin": first},
+			updatedTree:  map[string][]byte{"moved/renamed.bin": first},
+			removed:      []string{},
+			maxNewData:   0,
+		},
+		"should reuse chunks of file split into two files": {
+			originalTree: map[string][]byte{"a.bin": append(append([]byte{}, first...), second...)},
+			updatedTree:  map[string][]byte{"a.bin": first, "b.bin": second},
+			removed:      []string{},
+			maxNewData:   16 * 1024,
+		},
+		"should reuse chunks of two files merged into one": {
+			originalTree: map[string][]byte{"a.bin": first, "b.bin": second},
+			updatedTree:  map[string][]byte{"merged.bin": append(append([]byte{}, first...), second...)},
+			removed:      []string{"a.bin", "b.bin"},
+			maxNewData:   16 * 1024,
+		},
+		"should send whole new file": {
+			originalTree: map[string][]byte{"a.bin": first},
+			updatedTree:  map[string][]byte{"a.bin": first, "b.bin": second},
+			removed:      []string{},
+			maxNewData:   len(second),
+		},
+		"should handle small and empty files": {
+			originalTree: map[string][]byte{"small.txt": []byte("small"), "empty": {}},
+			updatedTree:  map[string][]byte{"small.txt": []byte("smaller"), "empty": {}},
+			removed:      []string{},
+			maxNewData:   len("smaller"),
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// given
+			original := writeTestTree(t, tc.originalTree)
+			updated := writeTestTree(t, tc.updatedTree)
+			target := filepath.Join(t.TempDir(), "target")
+
+			// when
+			delta, err := TreeDiff(original, updated, uint64(1024))
+			require.NoError(t, err)
+			err = ApplyTree(original, target, delta)
+
+			// then
+			require.NoError(t, err)
+			assert.Equal(t, tc.removed, delta.Removed)
+			assert.LessOrEqual(t, newDataSize(delta), tc.maxNewData)
+			assert.Equal(t, tc.updatedTree, readTestTree(t, target))
+		})
+	}
+
+	t.Run("should not apply delta on truncated original file", func(t *testing.T) {
+		// given
+		original := writeTestTree(t, map[string][]byte{"a.bin": first})
+		updated := writeTestTree(t, map[string][]byte{"a.bin": append(append([]byte{}, first...), second...)})
+		delta, err := TreeDiff(original, updated, uint64(1024))
+		require.NoError(t, err)
+		require.NoError(t, os.Truncate(filepath.Join(original, "a.bin"), int64(len(first)/2)))
+
+		// when
+		err = ApplyTree(original, filepath.Join(t.TempDir(), "target"), delta)
+
+		// then
+		assert.ErrorIs(t, err, ErrBaseMismatch)
+	})
+
+	t.Run("should not diff trees if chunk is not power of 2", func(t *testing.T) {
+		_, err := TreeDiff(t.TempDir(), t.TempDir(), uint64(9))
+		assert.ErrorContains(t, err, "chunkSize parameter must be a power of two")
+	})
+}
+
+func TestTreeDiffRenames(t *testing.T) {
+	first := randomData(1, 64*1024)
+	second := randomData(2, 64*1024)
+	edited := append(append([]byte{}, first[:32*1024]...), randomData(3, 1024)...)
+	edited = append(edited, first[32*1024:]...)
+
+	testCases := map[string]struct {
+		originalTree map[string][]byte
+		updatedTree  map[string][]byte
+		opts         []TreeOption
+		renames      map[string]string
+		removed      []string
+	}{
+		"should detect moved file": {
+			originalTree: map[string][]byte{"a.bin": first, "b.bin": second},
+			updatedTree:  map[string][]byte{"dir/a.bin": first, "b.bin": second},
+			renames:      map[string]string{"dir/a.bin": "a.bin"},
+			removed:      []string{},
+		},
+		"should detect renamed file edited after move": {
+			originalTree: map[string][]byte{"a.bin": first},
+			updatedTree:  map[string][]byte{"c.bin": edited},
+			renames:      map[string]string{"c.bin": "a.bin"},
+			removed:      []string{},
+		},
+		"should pair files with the most similar predecessors": {
+			originalTree: map[string][]byte{"a.bin": first, "b.bin": second},
+			updatedTree:  map[string][]byte{"c.bin": second, "d.bin": edited},
+			renames:      map[string]string{"c.bin": "b.bin", "d.bin": "a.bin"},
+			removed:      []string{},
+		},
+		"should not detect rename of completely different file": {
+			originalTree: map[string][]byte{"a.bin": first},
+			updatedTree:  map[string][]byte{"b.bin": second},
+			renames:      map[string]string{},
+			removed:      []string{"a.bin"},
+		},
+		"should not detect rename below threshold": {
+			originalTree: map[string][]byte{"a.bin": first},
+			updatedTree:  map[string][]byte{"c.bin": edited},
+			opts:         []TreeOption{WithRenameThreshold(1)},
+			renames:      map[string]string{},
+			removed:      []string{"a.bin"},
+		},
+		"should not detect rename of files smaller than minimal size": {
+			originalTree: map[string][]byte{"a.bin": first},
+			updatedTree:  map[string][]byte{"dir/a.bin": first},
+			opts:         []TreeOption{WithRenameMinSize(len(first) + 1)},
+			renames:      map[string]string{},
+			removed:      []string{"a.bin"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// given
+			original := writeTestTree(t, tc.originalTree)
+			updated := writeTestTree(t, tc.updatedTree)
+			target := filepath.Join(t.TempDir(), "target")
+
+			// when
+			delta, err := TreeDiff(original, updated, uint64(1024), tc.opts...)
+			require.NoError(t, err)
+			err = ApplyTree(original, target, delta)
+
+			// then
+			require.NoError(t, err)
+			renames := make(map[string]string)
+			for _, file := range delta.Files {
+				if file.RenamedFrom != "" {
+					renames[file.Path] = file.RenamedFrom
+				}
+			}
+			assert.Equal(t, tc.renames, renames)
+			assert.Equal(t, tc.removed, delta.Removed)
+			assert.Equal(t, tc.updatedTree, readTestTree(t, target))
+		})
+	}
+}
+
+func TestApplyTreeUnsafePaths(t *testing.T) {
+	file := Metadata{Mode: 0o644, UID: os.Getuid(), GID: os.Getgid()}
+	newData := []Segment{{Length: 4, Data: []byte("data")}}
+
+	testCases := map[string]struct {
+		files []FileDelta
+	}{
+		"should not write file outside of target": {
+			files: []FileDelta{{Path: "../escaped", Segments: newData, Metadata: file}},
+		},
+		"should not write file under absolute path": {
+			files: []FileDelta{{Path: "/escaped", Segments: newData, Metadata: file}},
+		},
+		"should not read renamed file outside of original": {
+			files: []FileDelta{{Path: "a", RenamedFrom: "../secret", Unchanged: true, Metadata: file}},
+		},
+		"should not read segment outside of original": {
+			files: []FileDelta{{Path: "a", Segments: []Segment{{Source: "../secret", Length: 6}}, Metadata: file}},
+		},
+		"should not write file through symbolic link": {
+			files: []FileDelta{
+				{Path: "link", Metadata: Metadata{Mode: os.ModeSymlink | 0o777, Symlink: "..", UID: os.Getuid(), GID: os.Getgid()}},
+				{Path: "link/escaped", Segments: newData, Metadata: file},
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// given
+			parent := t.TempDir()
+			original, target := filepath.Join(parent, "original"), filepath.Join(parent, "target")
+			require.NoError(t, os.Mkdir(original, 0o755))
+			require.NoError(t, os.WriteFile(filepath.Join(parent, "secret"), []byte("secret"), 0o644))
+
+			// when
+			err := ApplyTree(original, target, &TreeDelta{Files: tc.files})
+
+			// then
+			assert.ErrorIs(t, err, ErrUnsafePath)
+			assert.NoFileExists(t, filepath.Join(parent, "escaped"))
+			copied, _ := os.ReadFile(filepath.Join(target, "a"))
+			assert.NotContains(t, string(copied), "secret")
+		})
+	}
+}
+
+func randomData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func newDataSize(delta *TreeDelta) int {
+	size := 0
+	for _, file := range delta.Files {
+		for _, segment := range file.Segments {
+			size += len(segment.Data)
+		}
+	}
+	return size
+}
+
+func writeTestTree(t *testing.T, files map[string][]byte) string {
+	root := t.TempDir()
+	for path, content := range files {
+		fullPath := filepath.Join(root, filepath.FromSlash(path))
+		require.NoError(t, os.MkdirAll(filepath.Dir(fullPath), 0o755))
+		require.NoError(t, os.WriteFile(fullPath, content, 0o644))
+	}
+	return root
+}
+
+func readTestTree(t *testing.T, root string) map[string][]byte {
+	paths, metadata, err := listEntries(root)
+	require.NoError(t, err)
+
+	files := make(map[string][]byte, len(paths))
+	for _, path := range paths {
+		if !metadata[path].Mode.IsRegular() {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(path)))
+		require.NoError(t, err)
+		files[path] = content
+	}
+	return files
+}